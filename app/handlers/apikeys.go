@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"dunlap/app/log"
+	"dunlap/app/mongo"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	apiKeyDatabase        = "honda"
+	apiKeyCollection      = "apikeys"
+	apiKeyAuditCollection = "apikey_audit"
+)
+
+// Actions recorded in the API key audit collection.
+const (
+	AuditKeyCreated  = "create"
+	AuditKeyRotated  = "rotate"
+	AuditKeyDisabled = "disable"
+	AuditKeyExpired  = "expire"
+	AuditKeyDeleted  = "delete"
+)
+
+const (
+	KeyActive   = "active"
+	KeyDisabled = "disabled"
+	KeyExpired  = "expired"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	// ErrAPIKeyInactive is returned when rotating a key that is disabled,
+	// expired or already rotated, whose replacement would undo that.
+	ErrAPIKeyInactive = errors.New("API key is disabled, expired or already rotated")
+)
+
+// APIKeySpec is what an admin chooses when creating a key.
+type APIKeySpec struct {
+	Label             string     `json:"label"`
+	Owner             string     `json:"owner"`
+	Tenant            string     `json:"tenant,omitempty"`
+	Scopes            []string   `json:"scopes,omitempty"`
+	CarrierAllow      []string   `json:"carrierAllow,omitempty"`
+	CarrierDeny       []string   `json:"carrierDeny,omitempty"`
+	AutoClass         bool       `json:"autoClass,omitempty"`
+	RequestsPerMinute int        `json:"requestsPerMinute,omitempty"`
+	DailyStopQuota    int        `json:"dailyStopQuota,omitempty"`
+	MonthlyStopQuota  int        `json:"monthlyStopQuota,omitempty"`
+	ExpiresAt         *time.Time `json:"expiresAt,omitempty"`
+}
+
+// APIKeyView is a key document as admins see it, without its hash.
+type APIKeyView struct {
+	ID                string     `json:"id"`
+	Prefix            string     `json:"prefix,omitempty"`
+	Status            string     `json:"status"`
+	Label             string     `json:"label,omitempty"`
+	Owner             string     `json:"owner,omitempty"`
+	Tenant            string     `json:"tenant"`
+	Scopes            []string   `json:"scopes,omitempty"`
+	CarrierAllow      []string   `json:"carrierAllow,omitempty"`
+	CarrierDeny       []string   `json:"carrierDeny,omitempty"`
+	AutoClass         bool       `json:"autoClass,omitempty"`
+	RequestsPerMinute int        `json:"requestsPerMinute,omitempty"`
+	DailyStopQuota    int        `json:"dailyStopQuota,omitempty"`
+	MonthlyStopQuota  int        `json:"monthlyStopQuota,omitempty"`
+	CreatedAt         *time.Time `json:"createdAt,omitempty"`
+	LastUsedAt        *time.Time `json:"lastUsedAt,omitempty"`
+	ExpiresAt         *time.Time `json:"expiresAt,omitempty"`
+	RotatedFrom       string     `json:"rotatedFrom,omitempty"`
+	ReplacedBy        string     `json:"replacedBy,omitempty"`
+}
+
+// IssuedAPIKey is returned when a key is created or rotated. Token is only
+// ever shown this once.
+type IssuedAPIKey struct {
+	Key   APIKeyView `json:"key"`
+	Token string     `json:"token"`
+}
+
+// APIKeyAudit is one change to a key, written to the apikey_audit
+// collection. Actor is the ID of the admin key that made the change.
+type APIKeyAudit struct {
+	ID      string                 `json:"id" bson:"_id"`
+	KeyID   string                 `json:"keyId" bson:"keyId"`
+	Action  string                 `json:"action" bson:"action"`
+	Actor   string                 `json:"actor" bson:"actor"`
+	At      time.Time              `json:"at" bson:"at"`
+	Details map[string]interface{} `json:"details,omitempty" bson:"details,omitempty"`
+}
+
+func NewAPIKeyView(key *mongo.APIKey) APIKeyView {
+	view := APIKeyView{
+		ID:                key.ID.Hex(),
+		Prefix:            key.Prefix,
+		Status:            KeyActive,
+		Label:             key.Label,
+		Owner:             key.Owner,
+		Tenant:            key.TenantID(),
+		Scopes:            key.Scopes,
+		CarrierAllow:      key.CarrierAllow,
+		CarrierDeny:       key.CarrierDeny,
+		AutoClass:         key.AutoClass,
+		RequestsPerMinute: key.RequestsPerMinute,
+		DailyStopQuota:    key.DailyStopQuota,
+		MonthlyStopQuota:  key.MonthlyStopQuota,
+		LastUsedAt:        key.LastUsedAt,
+		ExpiresAt:         key.ExpiresAt,
+		RotatedFrom:       key.RotatedFrom,
+		ReplacedBy:        key.ReplacedBy,
+	}
+	if !key.CreatedAt.IsZero() {
+		createdAt := key.CreatedAt
+		view.CreatedAt = &createdAt
+	}
+	switch {
+	case key.Disabled:
+		view.Status = KeyDisabled
+	case !key.Active(time.Now()):
+		view.Status = KeyExpired
+	}
+	return view
+}
+
+func recordKeyAudit(ctx context.Context, keyID, action, actor string, details map[string]interface{}) {
+	entry := APIKeyAudit{
+		ID:      uuid.New().String(),
+		KeyID:   keyID,
+		Action:  action,
+		Actor:   actor,
+		At:      time.Now(),
+		Details: details,
+	}
+	if err := mongo.InsertDocument(ctx, apiKeyDatabase, apiKeyAuditCollection, entry); err != nil {
+		log.Error("Error recording %s of API key %s: %v", action, keyID, err)
+	}
+}
+
+// CreateAPIKey issues a new key and returns it with its token.
+func CreateAPIKey(ctx context.Context, spec APIKeySpec, actor string) (*IssuedAPIKey, error) {
+	key := &mongo.APIKey{
+		Tenant:            spec.Tenant,
+		Scopes:            spec.Scopes,
+		CarrierAllow:      spec.CarrierAllow,
+		CarrierDeny:       spec.CarrierDeny,
+		AutoClass:         spec.AutoClass,
+		RequestsPerMinute: spec.RequestsPerMinute,
+		DailyStopQuota:    spec.DailyStopQuota,
+		MonthlyStopQuota:  spec.MonthlyStopQuota,
+		Label:             spec.Label,
+		Owner:             spec.Owner,
+		CreatedAt:         time.Now(),
+		ExpiresAt:         spec.ExpiresAt,
+	}
+
+	token, err := mongo.IssueAPIKey(ctx, apiKeyDatabase, apiKeyCollection, key)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Created API key %s for %s", key.ID.Hex(), key.Owner)
+	recordKeyAudit(ctx, key.ID.Hex(), AuditKeyCreated, actor, map[string]interface{}{
+		"label": key.Label, "owner": key.Owner, "tenant": key.TenantID(), "scopes": key.Scopes,
+	})
+	return &IssuedAPIKey{Key: NewAPIKeyView(key), Token: token}, nil
+}
+
+// ListAPIKeys returns the keys matching the non-empty filters.
+func ListAPIKeys(ctx context.Context, owner, tenant string) ([]APIKeyView, error) {
+	filter := map[string]interface{}{}
+	if owner != "" {
+		filter["owner"] = owner
+	}
+	if tenant != "" {
+		filter["tenant"] = tenant
+	}
+
+	var keys []mongo.APIKey
+	if err := mongo.FindDocuments(ctx, apiKeyDatabase, apiKeyCollection, filter, &keys); err != nil {
+		return nil, err
+	}
+
+	views := make([]APIKeyView, 0, len(keys))
+	for i := range keys {
+		views = append(views, NewAPIKeyView(&keys[i]))
+	}
+	return views, nil
+}
+
+// RotateAPIKey issues a replacement with the same settings and expiry as key
+// id and lets the old key keep working for grace so callers can switch over
+// without downtime. Only active keys that have not been rotated already can
+// be rotated.
+func RotateAPIKey(ctx context.Context, id string, grace time.Duration, actor string) (*IssuedAPIKey, error) {
+	old, err := mongo.FindAPIKeyByID(ctx, apiKeyDatabase, apiKeyCollection, id)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	now := time.Now()
+	if !old.Active(now) || old.ReplacedBy != "" {
+		return nil, ErrAPIKeyInactive
+	}
+
+	replacement := *old
+	replacement.CreatedAt = now
+	replacement.LastUsedAt = nil
+	replacement.RotatedFrom = id
+	replacement.Lineage = old.UsageID()
+	replacement.ReplacedBy = ""
+	// Keys from before tenants existed are scoped by their own ID, which
+	// the replacement must keep.
+	replacement.Tenant = old.TenantID()
+
+	token, err := mongo.IssueAPIKey(ctx, apiKeyDatabase, apiKeyCollection, &replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	graceEnds := now.Add(grace)
+	if old.ExpiresAt != nil && old.ExpiresAt.Before(graceEnds) {
+		graceEnds = *old.ExpiresAt
+	}
+	fields := map[string]interface{}{"expiresAt": graceEnds, "replacedBy": replacement.ID.Hex()}
+	if _, err := mongo.UpdateAPIKey(ctx, apiKeyDatabase, apiKeyCollection, id, fields); err != nil {
+		return nil, err
+	}
+
+	log.Info("Rotated API key %s to %s, old key expires %s", id, replacement.ID.Hex(), graceEnds.Format(time.RFC3339))
+	recordKeyAudit(ctx, id, AuditKeyRotated, actor, map[string]interface{}{
+		"replacedBy": replacement.ID.Hex(), "expiresAt": graceEnds,
+	})
+	recordKeyAudit(ctx, replacement.ID.Hex(), AuditKeyCreated, actor, map[string]interface{}{
+		"rotatedFrom": id,
+	})
+	return &IssuedAPIKey{Key: NewAPIKeyView(&replacement), Token: token}, nil
+}
+
+// DisableAPIKey stops key id from authenticating.
+func DisableAPIKey(ctx context.Context, id, actor string) error {
+	found, err := mongo.UpdateAPIKey(ctx, apiKeyDatabase, apiKeyCollection, id, map[string]interface{}{"disabled": true})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrAPIKeyNotFound
+	}
+
+	log.Info("Disabled API key %s", id)
+	recordKeyAudit(ctx, id, AuditKeyDisabled, actor, nil)
+	return nil
+}
+
+// ExpireAPIKey sets when key id stops authenticating.
+func ExpireAPIKey(ctx context.Context, id string, at time.Time, actor string) error {
+	found, err := mongo.UpdateAPIKey(ctx, apiKeyDatabase, apiKeyCollection, id, map[string]interface{}{"expiresAt": at})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrAPIKeyNotFound
+	}
+
+	log.Info("API key %s expires %s", id, at.Format(time.RFC3339))
+	recordKeyAudit(ctx, id, AuditKeyExpired, actor, map[string]interface{}{"expiresAt": at})
+	return nil
+}
+
+// DeleteAPIKey removes key id. Its audit history is kept.
+func DeleteAPIKey(ctx context.Context, id, actor string) error {
+	found, err := mongo.DeleteAPIKey(ctx, apiKeyDatabase, apiKeyCollection, id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrAPIKeyNotFound
+	}
+
+	log.Info("Deleted API key %s", id)
+	recordKeyAudit(ctx, id, AuditKeyDeleted, actor, nil)
+	return nil
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"context"
+	"dunlap/app/log"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type BreakerConfig struct {
+	Window         int           `json:"window"`
+	MinRequests    int           `json:"minRequests"`
+	FailureRatio   float64       `json:"failureRatio"`
+	CoolDown       time.Duration `json:"-"`
+	HalfOpenProbes int           `json:"halfOpenProbes"`
+}
+
+func LoadBreakerConfig() BreakerConfig {
+	config := BreakerConfig{
+		Window:         envInt("BREAKER_WINDOW", 50),
+		MinRequests:    envInt("BREAKER_MIN_REQUESTS", 10),
+		FailureRatio:   envFloat("BREAKER_FAILURE_RATIO", 0.5),
+		CoolDown:       envDuration("BREAKER_COOL_DOWN", 30*time.Second),
+		HalfOpenProbes: envInt("BREAKER_HALF_OPEN_PROBES", 1),
+	}
+	if config.Window < 1 {
+		config.Window = 1
+	}
+	if config.MinRequests > config.Window {
+		config.MinRequests = config.Window
+	}
+	if config.HalfOpenProbes < 1 {
+		config.HalfOpenProbes = 1
+	}
+	return config
+}
+
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+// CircuitBreaker trips open when the failure ratio over the last Window
+// calls reaches FailureRatio, rejects calls for CoolDown, then lets
+// HalfOpenProbes calls through to decide whether to close again.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	config   BreakerConfig
+	state    BreakerState
+	outcomes []bool
+	next     int
+	count    int
+	failures int
+	openedAt time.Time
+	changed  time.Time
+	probes   int
+	passed   int
+	rejected uint64
+}
+
+// Breaker guards every call to REVCON_API_URL.
+var Breaker = NewCircuitBreaker(BreakerConfig{Window: 50, MinRequests: 10, FailureRatio: 0.5, CoolDown: 30 * time.Second, HalfOpenProbes: 1})
+
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config:   config,
+		outcomes: make([]bool, config.Window),
+		changed:  time.Now(),
+	}
+}
+
+// Call runs fn if the breaker allows it and records the result. When the
+// breaker is open it returns ErrCircuitOpen without calling fn. ctx is the
+// context fn runs under.
+func (b *CircuitBreaker) Call(ctx context.Context, fn func() error) error {
+	probe, ok := b.allow()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	b.record(probe, breakerOutcomeOf(ctx, err))
+	return err
+}
+
+func (b *CircuitBreaker) allow() (probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.CoolDown {
+			b.rejected++
+			return false, false
+		}
+		b.setStateLocked(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= b.config.HalfOpenProbes {
+			b.rejected++
+			return false, false
+		}
+		b.probes++
+		return true, true
+	}
+	return false, true
+}
+
+func (b *CircuitBreaker) record(probe bool, outcome breakerOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probes--
+		if b.state != BreakerHalfOpen {
+			return
+		}
+		switch outcome {
+		case outcomeFailure:
+			b.setStateLocked(BreakerOpen)
+		case outcomeSuccess:
+			b.passed++
+			if b.passed >= b.config.HalfOpenProbes {
+				b.setStateLocked(BreakerClosed)
+			}
+		}
+		return
+	}
+
+	if b.state != BreakerClosed || outcome == outcomeIgnored {
+		return
+	}
+
+	if b.count == len(b.outcomes) {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+	} else {
+		b.count++
+	}
+	failed := outcome == outcomeFailure
+	b.outcomes[b.next] = failed
+	if failed {
+		b.failures++
+	}
+	b.next = (b.next + 1) % len(b.outcomes)
+
+	if b.count >= b.config.MinRequests && float64(b.failures)/float64(b.count) >= b.config.FailureRatio {
+		b.setStateLocked(BreakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) setStateLocked(state BreakerState) {
+	log.Warning("RevCon circuit breaker %s -> %s (%d/%d failures)", b.state, state, b.failures, b.count)
+	b.state = state
+	b.changed = time.Now()
+	b.passed = 0
+	switch state {
+	case BreakerOpen:
+		b.openedAt = b.changed
+	case BreakerClosed:
+		b.count, b.failures, b.next = 0, 0, 0
+	}
+}
+
+// breakerOutcomeOf treats anything that shows upstream answering sensibly as
+// a success. Cancellations and the caller going away, such as on a short
+// X-Batch-Deadline, say nothing about upstream health; a call running out the
+// middleware's own timeout counts against it.
+func breakerOutcomeOf(ctx context.Context, err error) breakerOutcome {
+	if err == nil {
+		return outcomeSuccess
+	}
+	if errors.Is(err, context.Canceled) || callerDone(ctx) {
+		return outcomeIgnored
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode < 500 {
+		return outcomeSuccess
+	}
+	return outcomeFailure
+}
+
+type BreakerSnapshot struct {
+	State        string        `json:"state"`
+	Since        time.Time     `json:"since"`
+	Requests     int           `json:"requests"`
+	Failures     int           `json:"failures"`
+	FailureRatio float64       `json:"failureRatio"`
+	RetryAt      *time.Time    `json:"retryAt,omitempty"`
+	Rejected     uint64        `json:"rejected"`
+	CoolDown     string        `json:"coolDown"`
+	Config       BreakerConfig `json:"config"`
+}
+
+func (b *CircuitBreaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := BreakerSnapshot{
+		State:    b.state.String(),
+		Since:    b.changed,
+		Requests: b.count,
+		Failures: b.failures,
+		Rejected: b.rejected,
+		CoolDown: b.config.CoolDown.String(),
+		Config:   b.config,
+	}
+	if b.count > 0 {
+		snapshot.FailureRatio = float64(b.failures) / float64(b.count)
+	}
+	if b.state == BreakerOpen {
+		retryAt := b.openedAt.Add(b.config.CoolDown)
+		snapshot.RetryAt = &retryAt
+	}
+	return snapshot
+}
+
+type callerKey struct{}
+
+// withCaller marks ctx as the context of whoever an upstream call is made
+// for. Deadlines added beneath it, such as the upstream and per-attempt
+// timeouts, belong to the middleware itself.
+func withCaller(ctx context.Context) context.Context {
+	return context.WithValue(ctx, callerKey{}, ctx)
+}
+
+// callerDone reports whether whoever the call running under ctx was made for
+// has stopped waiting. Without a marked caller it never has.
+func callerDone(ctx context.Context) bool {
+	caller, ok := ctx.Value(callerKey{}).(context.Context)
+	return ok && caller.Err() != nil
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func hungCall(ctx context.Context) func() error {
+	return func() error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+}
+
+func TestBreakerCountsUpstreamTimeouts(t *testing.T) {
+	breaker := NewCircuitBreaker(BreakerConfig{Window: 10, MinRequests: 10, FailureRatio: 0.5, CoolDown: time.Minute, HalfOpenProbes: 1})
+	inflight := NewCoalescer()
+
+	for i := 0; i < 5; i++ {
+		inflight.Do(context.Background(), "stop", func(ctx context.Context) upstreamResult {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			return upstreamResult{err: breaker.Call(ctx, hungCall(ctx))}
+		})
+	}
+
+	snapshot := breaker.Snapshot()
+	if snapshot.Failures != 5 {
+		t.Fatalf("got %d failures after 5 hung calls, want 5", snapshot.Failures)
+	}
+}
+
+func TestBreakerIgnoresCallerGoingAway(t *testing.T) {
+	breaker := NewCircuitBreaker(BreakerConfig{Window: 10, MinRequests: 10, FailureRatio: 0.5, CoolDown: time.Minute, HalfOpenProbes: 1})
+	inflight := NewCoalescer()
+
+	done := make(chan struct{})
+	batchCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	inflight.Do(batchCtx, "stop", func(ctx context.Context) upstreamResult {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		return upstreamResult{err: breaker.Call(ctx, hungCall(ctx))}
+	})
+	<-done
+
+	snapshot := breaker.Snapshot()
+	if snapshot.Requests != 0 || snapshot.Failures != 0 {
+		t.Fatalf("got %d/%d failures after the caller went away, want none recorded", snapshot.Failures, snapshot.Requests)
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import "fmt"
+
+// CarrierPolicy restricts which carriers a tenant may be quoted. An empty
+// Allow list allows every carrier not on Deny.
+type CarrierPolicy struct {
+	Allow []string `json:"allow,omitempty" bson:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty" bson:"deny,omitempty"`
+}
+
+func NewCarrierPolicy(allow, deny []string) CarrierPolicy {
+	policy := CarrierPolicy{}
+	for _, scac := range allow {
+		if scac = normalizeCode(scac); scac != "" {
+			policy.Allow = append(policy.Allow, scac)
+		}
+	}
+	for _, scac := range deny {
+		if scac = normalizeCode(scac); scac != "" {
+			policy.Deny = append(policy.Deny, scac)
+		}
+	}
+	return policy
+}
+
+type FilteredCarrier struct {
+	Scac   string `json:"scac"`
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// StopDebug explains what the middleware did to a stop's quotes. It is only
+// sent when the request asks for it with debug=true.
+type StopDebug struct {
+	FilteredCarriers []FilteredCarrier `json:"filteredCarriers,omitempty"`
+}
+
+// Apply removes quotes from carriers the policy does not permit, recording
+// each removal in response.Debug when debug is set.
+func (c CarrierPolicy) Apply(response *ResponseWithStopID, debug bool) {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 {
+		return
+	}
+
+	kept := response.Response[:0:0]
+	for _, quote := range response.Response {
+		reason := c.reject(quote.Scac)
+		if reason == "" {
+			kept = append(kept, quote)
+			continue
+		}
+		if debug {
+			if response.Debug == nil {
+				response.Debug = &StopDebug{}
+			}
+			response.Debug.FilteredCarriers = append(response.Debug.FilteredCarriers, FilteredCarrier{Scac: quote.Scac, Name: quote.Name, Reason: reason})
+		}
+	}
+	response.Response = kept
+}
+
+func (c CarrierPolicy) reject(scac string) string {
+	if containsCode(c.Deny, scac) {
+		return fmt.Sprintf("carrier %s is on the deny list", scac)
+	}
+	if len(c.Allow) > 0 && !containsCode(c.Allow, scac) {
+		return fmt.Sprintf("carrier %s is not on the allow list", scac)
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamResult is what one rating call to a provider produced.
+type upstreamResult struct {
+	quotes    []APIResponseItem
+	attempts  int
+	queueWait time.Duration
+	hedged    bool
+	err       error
+}
+
+type flight struct {
+	done    chan struct{}
+	result  upstreamResult
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Coalescer collapses concurrent calls that share a key into one upstream
+// call whose result is handed to every caller. The shared call is only
+// cancelled once every caller waiting on it has gone away.
+type Coalescer struct {
+	mu       sync.Mutex
+	flights  map[string]*flight
+	upstream uint64
+	saved    uint64
+}
+
+// Inflight de-duplicates identical rating calls across a tenant's batches.
+var Inflight = NewCoalescer()
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{flights: make(map[string]*flight)}
+}
+
+// Do runs fn for key unless an identical call is already in flight, in which
+// case it waits for that call instead. shared reports whether the result came
+// from another caller's call. fn does not inherit any caller's deadline, since
+// callers joining later may wait longer; its context is cancelled once the
+// last caller stops waiting, so fn must bound itself.
+func (c *Coalescer) Do(ctx context.Context, key string, fn func(ctx context.Context) upstreamResult) (result upstreamResult, shared bool) {
+	c.mu.Lock()
+	f, shared := c.flights[key]
+	if shared {
+		f.waiters++
+		atomic.AddUint64(&c.saved, 1)
+	} else {
+		f = c.start(key, fn)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, shared
+	case <-ctx.Done():
+		c.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			c.forget(key, f)
+		}
+		c.mu.Unlock()
+		return upstreamResult{err: ctx.Err()}, shared
+	}
+}
+
+func (c *Coalescer) start(key string, fn func(ctx context.Context) upstreamResult) *flight {
+	flightCtx, cancel := context.WithCancel(context.Background())
+
+	f := &flight{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	c.flights[key] = f
+	atomic.AddUint64(&c.upstream, 1)
+
+	go func() {
+		defer cancel()
+		result := fn(withCaller(flightCtx))
+		c.mu.Lock()
+		c.forget(key, f)
+		c.mu.Unlock()
+		f.result = result
+		close(f.done)
+	}()
+
+	return f
+}
+
+// forget removes f from the in-flight set unless a newer call has already
+// replaced it. Callers must hold c.mu.
+func (c *Coalescer) forget(key string, f *flight) {
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+}
+
+type CoalescerStats struct {
+	UpstreamCalls uint64 `json:"upstreamCalls"`
+	Saved         uint64 `json:"saved"`
+	InFlight      int    `json:"inFlight"`
+}
+
+func (c *Coalescer) Stats() CoalescerStats {
+	c.mu.Lock()
+	inFlight := len(c.flights)
+	c.mu.Unlock()
+	return CoalescerStats{
+		UpstreamCalls: atomic.LoadUint64(&c.upstream),
+		Saved:         atomic.LoadUint64(&c.saved),
+		InFlight:      inFlight,
+	}
+}
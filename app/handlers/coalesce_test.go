@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCoalescerOutlivesFirstCallersDeadline(t *testing.T) {
+	inflight := NewCoalescer()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		inflight.Do(ctx, "stop", func(ctx context.Context) upstreamResult {
+			close(started)
+			select {
+			case <-release:
+				return upstreamResult{quotes: []APIResponseItem{}}
+			case <-ctx.Done():
+				return upstreamResult{err: ctx.Err()}
+			}
+		})
+	}()
+	<-started
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	result, shared := inflight.Do(context.Background(), "stop", nil)
+	if !shared {
+		t.Fatal("second caller did not join the in-flight call")
+	}
+	if result.err != nil {
+		t.Fatalf("second caller got %v after the first caller's deadline, want the shared result", result.err)
+	}
+}
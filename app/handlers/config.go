@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"dunlap/app/log"
+	"os"
+	"strconv"
+	"time"
+)
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warning("Invalid duration for %s: %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warning("Invalid integer for %s: %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Warning("Invalid number for %s: %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+func envBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warning("Invalid boolean for %s: %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+// InitializeUpstream applies the environment configuration to the shared
+// upstream guards. It must run after the .env file has been loaded and Mongo
+// is connected.
+func InitializeUpstream() {
+	Breaker = NewCircuitBreaker(LoadBreakerConfig())
+	Quotes = LoadQuoteCache()
+	Limiter = LoadConcurrencyLimiter()
+	Outbound = LoadRateLimits()
+	Hedging = LoadHedger()
+	Calendar = LoadBusinessCalendar()
+	RateProviders = LoadRateProviders()
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// BatchDeadlineHeader lets a client bound the whole batch, either as a
+// number of seconds from now or as an RFC 3339 timestamp.
+const BatchDeadlineHeader = "X-Batch-Deadline"
+
+// BatchContext derives the context a batch runs under from the incoming
+// request, so a client disconnect or an expired X-Batch-Deadline stops any
+// further upstream calls.
+func BatchContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	value := r.Header.Get(BatchDeadlineHeader)
+	if value == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+
+	var deadline time.Time
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		deadline = time.Now().Add(time.Duration(seconds * float64(time.Second)))
+	} else if at, err := time.Parse(time.RFC3339, value); err == nil {
+		deadline = at
+	} else {
+		return nil, nil, fmt.Errorf("invalid %s header %q: expected seconds or an RFC 3339 timestamp", BatchDeadlineHeader, value)
+	}
+
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return ctx, cancel, nil
+}
+
+// abandonedResponse describes a stop that was never finished because the
+// batch context ended first.
+func abandonedResponse(ctx context.Context, req PayloadRequest) ResponseWithStopID {
+	response := ResponseWithStopID{StopID: req.StopId, OriginalStopID: req.OriginalStopId}
+	markAbandoned(ctx, &response)
+	return response
+}
+
+func markAbandoned(ctx context.Context, response *ResponseWithStopID) {
+	if ctx.Err() == context.DeadlineExceeded {
+		response.Error = "batch deadline exceeded before this stop finished"
+		response.ErrorCode = ErrorCodeTimeout
+		return
+	}
+	response.Error = "request cancelled before this stop finished"
+	response.ErrorCode = ErrorCodeCancelled
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// densityClasses maps the lower bound of each density band (lb/ft³) to its
+// freight class, densest first.
+var densityClasses = []struct {
+	minDensity float64
+	class      string
+}{
+	{50, "50"},
+	{35, "55"},
+	{30, "60"},
+	{22.5, "65"},
+	{15, "70"},
+	{13.5, "77.5"},
+	{12, "85"},
+	{10.5, "92.5"},
+	{9, "100"},
+	{8, "110"},
+	{7, "125"},
+	{6, "150"},
+	{5, "175"},
+	{4, "200"},
+	{3, "250"},
+	{2, "300"},
+	{1, "400"},
+	{0, "500"},
+}
+
+// ItemClassification reports the density and class the middleware computed
+// for one item and whether it replaced what the caller sent.
+type ItemClassification struct {
+	Item          int     `json:"item"`
+	Density       float64 `json:"density"`
+	ComputedClass string  `json:"computedClass"`
+	SuppliedClass string  `json:"suppliedClass,omitempty"`
+	Mismatch      bool    `json:"mismatch"`
+	Applied       bool    `json:"applied"`
+}
+
+// itemDensity returns pounds per cubic foot for an item whose dimensions are
+// per piece in inches and whose weight is the line total in pounds.
+func itemDensity(item FreightItem) (float64, bool) {
+	if item.Length <= 0 || item.Width <= 0 || item.Height <= 0 || item.Weight <= 0 {
+		return 0, false
+	}
+	pieces := item.Pieces
+	if pieces < 1 {
+		pieces = 1
+	}
+	cubicFeet := float64(item.Length*item.Width*item.Height*pieces) / 1728
+	return float64(item.Weight) / cubicFeet, true
+}
+
+func densityClass(density float64) string {
+	for _, band := range densityClasses {
+		if density >= band.minDensity {
+			return band.class
+		}
+	}
+	return "500"
+}
+
+// ClassifyRequests computes density for every item with dimensions and fills
+// in the density-based class when the caller left it blank, or always when
+// autoClass is set. The findings are kept on each request's Classification.
+func ClassifyRequests(requests []PayloadRequest, autoClass bool) {
+	for i := range requests {
+		items := requests[i].FreightDetails.Items
+		var classifications []ItemClassification
+
+		for j := range items {
+			item := &items[j]
+			density, ok := itemDensity(*item)
+			if !ok {
+				continue
+			}
+
+			supplied := strings.TrimSpace(item.Class)
+			computed := densityClass(density)
+			result := ItemClassification{
+				Item:          j,
+				Density:       math.Round(density*100) / 100,
+				ComputedClass: computed,
+				SuppliedClass: supplied,
+				Mismatch:      supplied != "" && supplied != computed,
+			}
+
+			if supplied == "" || autoClass {
+				item.Class = computed
+				result.Applied = supplied != computed
+			}
+			if sent, err := strconv.ParseFloat(strings.TrimSpace(item.Density), 64); err != nil || sent == 0 || autoClass {
+				item.Density = strconv.FormatFloat(result.Density, 'f', 2, 64)
+			}
+			classifications = append(classifications, result)
+		}
+
+		requests[i].Classification = classifications
+	}
+}
@@ -1,45 +1,276 @@
 package handlers
 
 import (
+	"context"
 	"dunlap/app/log"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-func GetOAuthToken() (string, error) {
+var authClient = &http.Client{Timeout: 30 * time.Second}
+
+// OAuthToken is an access token returned by AUTH_URL together with the
+// moment it stops being valid.
+type OAuthToken struct {
+	AccessToken string
+	ExpiresAt   time.Time
+}
+
+// FetchOAuthToken always performs a round trip to AUTH_URL. Callers on the
+// rating path should go through Tokens instead.
+func FetchOAuthToken(ctx context.Context) (OAuthToken, error) {
 	data := url.Values{
 		"client_id":     {os.Getenv("CLIENT_ID")},
 		"client_secret": {os.Getenv("CLIENT_SECRET")},
 		"grant_type":    {os.Getenv("GRANT_TYPE")},
 	}
 
-	resp, err := http.PostForm(os.Getenv("AUTH_URL"), data)
+	req, err := http.NewRequestWithContext(ctx, "POST", os.Getenv("AUTH_URL"), strings.NewReader(data.Encode()))
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := authClient.Do(req)
 	if err != nil {
 		log.Error("Posting to auth url: %v", err)
-		return "", err
+		return OAuthToken{}, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Error("non-OK HTTP status: %v", resp.Status)
-		return "", err
+		return OAuthToken{}, fmt.Errorf("auth server returned %s", resp.Status)
 	}
 
-	var result map[string]interface{}
+	var result struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		log.Error("Error decoding json %v", err)
+		return OAuthToken{}, err
+	}
+
+	if result.AccessToken == "" {
+		log.Error("Problem gettting access token: response has no access_token")
+		return OAuthToken{}, errors.New("auth response has no access_token")
+	}
+
+	lifetime := envDuration("OAUTH_DEFAULT_TTL", 5*time.Minute)
+	if seconds, err := result.ExpiresIn.Float64(); err == nil && seconds > 0 {
+		lifetime = time.Duration(seconds * float64(time.Second))
+	}
+
+	log.Info("Successfully got Auth Token, expires in %v", lifetime)
+	return OAuthToken{AccessToken: result.AccessToken, ExpiresAt: time.Now().Add(lifetime)}, nil
+}
+
+// Backoff between failed token refreshes, doubling from tokenRetryBase.
+const (
+	tokenRetryBase = time.Second
+	tokenRetryMax  = time.Minute
+)
+
+// TokenManager caches the upstream access token and refreshes it ahead of
+// expiry. Concurrent callers share a single in-flight refresh, and after a
+// failed refresh no new one starts until the backoff has passed.
+type TokenManager struct {
+	mu         sync.Mutex
+	token      OAuthToken
+	obtainedAt time.Time
+	inflight   chan struct{}
+	lastErr    error
+	failures   int
+	retryAt    time.Time
+	refreshAt  *time.Timer
+	skew       time.Duration
+	fetch      func(ctx context.Context) (OAuthToken, error)
+}
+
+// Tokens is the process-wide token cache used by the rating path.
+var Tokens = NewTokenManager(FetchOAuthToken)
+
+func NewTokenManager(fetch func(ctx context.Context) (OAuthToken, error)) *TokenManager {
+	return &TokenManager{
+		fetch: fetch,
+		skew:  -1,
+	}
+}
+
+// refreshSkew is how long before expiry the current token is refreshed. It
+// is clamped to a quarter of the token's lifetime so short-lived tokens are
+// not refreshed on every call.
+func (m *TokenManager) refreshSkew() time.Duration {
+	if m.skew < 0 {
+		m.skew = envDuration("OAUTH_REFRESH_SKEW", 60*time.Second)
+	}
+	if lifetime := m.token.ExpiresAt.Sub(m.obtainedAt); m.skew > lifetime/4 {
+		return lifetime / 4
+	}
+	return m.skew
+}
+
+// Token returns a valid access token, fetching one only when the cache is
+// empty or expired. A token inside the refresh window is still returned while
+// a background refresh replaces it.
+func (m *TokenManager) Token(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	now := time.Now()
+	if m.token.AccessToken != "" && now.Before(m.token.ExpiresAt) {
+		token := m.token.AccessToken
+		if now.After(m.token.ExpiresAt.Add(-m.refreshSkew())) && !now.Before(m.retryAt) {
+			m.startRefreshLocked()
+		}
+		m.mu.Unlock()
+		return token, nil
+	}
+	if m.inflight == nil && m.lastErr != nil && now.Before(m.retryAt) {
+		err := m.lastErr
+		m.mu.Unlock()
 		return "", err
 	}
+	done := m.startRefreshLocked()
+	m.mu.Unlock()
 
-	token, ok := result["access_token"].(string)
-	if !ok {
-		log.Error("Problem gettting access token %v", err)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token.AccessToken != "" && time.Now().Before(m.token.ExpiresAt) {
+		return m.token.AccessToken, nil
+	}
+	if m.lastErr != nil {
+		return "", m.lastErr
+	}
+	return "", errors.New("no access token available")
+}
+
+// Invalidate drops the cached token if it is still the one the caller saw
+// rejected, so a burst of 401s only triggers one refresh.
+func (m *TokenManager) Invalidate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token.AccessToken == token {
+		log.Warning("Access token rejected upstream, invalidating")
+		m.token = OAuthToken{}
+	}
+}
+
+func (m *TokenManager) startRefreshLocked() chan struct{} {
+	if m.inflight != nil {
+		return m.inflight
+	}
+	done := make(chan struct{})
+	m.inflight = done
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), authClient.Timeout)
+		defer cancel()
+		token, err := m.fetch(ctx)
+
+		m.mu.Lock()
+		if err != nil {
+			m.failures++
+			backoff := tokenRetryBase << (m.failures - 1)
+			if backoff > tokenRetryMax || backoff <= 0 {
+				backoff = tokenRetryMax
+			}
+			m.retryAt = time.Now().Add(backoff)
+			log.Error("Refreshing access token: %v, retrying in %v", err, backoff)
+		} else {
+			m.token = token
+			m.obtainedAt = time.Now()
+			m.failures = 0
+			m.retryAt = time.Time{}
+			m.scheduleRefreshLocked()
+		}
+		m.lastErr = err
+		m.inflight = nil
+		m.mu.Unlock()
+		close(done)
+	}()
+
+	return done
+}
+
+func (m *TokenManager) scheduleRefreshLocked() {
+	if m.refreshAt != nil {
+		m.refreshAt.Stop()
+	}
+	wait := time.Until(m.token.ExpiresAt.Add(-m.refreshSkew()))
+	if wait <= 0 {
+		return
+	}
+	m.refreshAt = time.AfterFunc(wait, func() {
+		m.mu.Lock()
+		m.startRefreshLocked()
+		m.mu.Unlock()
+	})
+}
+
+func bearerHeaders(headers map[string]string, token string) map[string]string {
+	out := make(map[string]string, len(headers)+1)
+	for key, value := range headers {
+		out[key] = value
+	}
+	out["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	return out
+}
+
+// postWithAuth sends the payload with the current access token and, if
+// upstream answers 401, invalidates it and retries once with a fresh one.
+func postWithAuth(ctx context.Context, client *http.Client, url string, headers map[string]string, jsonPayload map[string]interface{}, stopID int) (string, error) {
+	token, err := Tokens.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := postUpstream(ctx, client, url, bearerHeaders(headers, token), jsonPayload, stopID)
+	var statusErr *StatusError
+	if err == nil || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	Tokens.Invalidate(token)
+	token, err = Tokens.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	log.Info("[StopID: %d] Retrying with refreshed access token", stopID)
+	return postUpstream(ctx, client, url, bearerHeaders(headers, token), jsonPayload, stopID)
+}
+
+// postUpstream paces the call through the endpoint's token bucket and then
+// sends it through the circuit breaker.
+func postUpstream(ctx context.Context, client *http.Client, url string, headers map[string]string, jsonPayload map[string]interface{}, stopID int) (string, error) {
+	bucket := Outbound.For(url)
+	if err := bucket.Wait(ctx); err != nil {
 		return "", err
 	}
-	log.Info("Successfully got Auth Token")
-	return token, nil
+
+	var response string
+	err := Breaker.Call(ctx, func() error {
+		var err error
+		response, err = PostRequestWithContext(ctx, client, url, headers, jsonPayload, stopID)
+		return err
+	})
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+		bucket.Throttle()
+	}
+	return response, err
 }
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const hedgeMinSamples = 20
+
+// Hedger sends a second, identical upstream call when the first has not
+// answered within the configured latency percentile, and keeps whichever
+// finishes first. Hedges are paid for out of a budget that grows by MaxRatio
+// per call, so they never exceed that fraction of upstream traffic.
+type Hedger struct {
+	mu         sync.Mutex
+	enabled    bool
+	percentile float64
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	maxRatio   float64
+	budget     float64
+	samples    []time.Duration
+	next       int
+	full       bool
+	calls      uint64
+	hedges     uint64
+	hedgeWins  uint64
+}
+
+// Hedging is applied to every provider attempt. It is off unless HEDGE_ENABLED
+// is set.
+var Hedging = NewHedger(false, 0.95, 500*time.Millisecond, 10*time.Second, 0.1)
+
+func NewHedger(enabled bool, percentile float64, minDelay, maxDelay time.Duration, maxRatio float64) *Hedger {
+	return &Hedger{
+		enabled:    enabled,
+		percentile: percentile,
+		minDelay:   minDelay,
+		maxDelay:   maxDelay,
+		maxRatio:   maxRatio,
+		samples:    make([]time.Duration, 200),
+	}
+}
+
+func LoadHedger() *Hedger {
+	return NewHedger(
+		envBool("HEDGE_ENABLED", false),
+		envFloat("HEDGE_PERCENTILE", 0.95),
+		envDuration("HEDGE_MIN_DELAY", 500*time.Millisecond),
+		envDuration("HEDGE_MAX_DELAY", 10*time.Second),
+		envFloat("HEDGE_MAX_RATIO", 0.1),
+	)
+}
+
+type hedgeOutcome struct {
+	quotes  []APIResponseItem
+	err     error
+	hedge   bool
+	elapsed time.Duration
+}
+
+// Do runs call and, if it is still outstanding after the hedge delay and the
+// budget allows, runs it a second time. The second call needs its own
+// upstream slot from reserve, which must not block; without one the hedge is
+// skipped. The slower call is cancelled. hedged reports whether a second call
+// was sent.
+func (h *Hedger) Do(ctx context.Context, reserve func() (func(), bool), call func(ctx context.Context) ([]APIResponseItem, error)) (quotes []APIResponseItem, hedged bool, err error) {
+	if !h.enabled {
+		quotes, err = call(ctx)
+		return quotes, false, err
+	}
+
+	delay := h.begin()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeOutcome, 2)
+	launch := func(hedge bool, release func()) {
+		go func() {
+			if release != nil {
+				defer release()
+			}
+			start := time.Now()
+			quotes, err := call(ctx)
+			results <- hedgeOutcome{quotes: quotes, err: err, hedge: hedge, elapsed: time.Since(start)}
+		}()
+	}
+
+	launch(false, nil)
+	running := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			release, ok := reserve()
+			if !ok {
+				continue
+			}
+			if !h.spend() {
+				release()
+				continue
+			}
+			hedged = true
+			running++
+			launch(true, release)
+		case out := <-results:
+			running--
+			if out.err == nil {
+				h.finish(out)
+				return out.quotes, hedged, nil
+			}
+			if firstErr == nil {
+				firstErr = out.err
+			}
+			if running == 0 {
+				return nil, hedged, firstErr
+			}
+		}
+	}
+}
+
+// begin earns budget for one call and returns how long to wait before
+// hedging it.
+func (h *Hedger) begin() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.calls++
+	h.budget += h.maxRatio
+	if h.budget > 10 {
+		h.budget = 10
+	}
+
+	count := h.next
+	if h.full {
+		count = len(h.samples)
+	}
+	if count < hedgeMinSamples {
+		return h.maxDelay
+	}
+
+	sorted := make([]time.Duration, count)
+	copy(sorted, h.samples[:count])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	delay := sorted[int(h.percentile*float64(count-1))]
+	if delay < h.minDelay {
+		delay = h.minDelay
+	}
+	if delay > h.maxDelay {
+		delay = h.maxDelay
+	}
+	return delay
+}
+
+func (h *Hedger) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.budget < 1 {
+		return false
+	}
+	h.budget--
+	h.hedges++
+	return true
+}
+
+func (h *Hedger) finish(out hedgeOutcome) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if out.hedge {
+		h.hedgeWins++
+	}
+	h.samples[h.next] = out.elapsed
+	h.next++
+	if h.next == len(h.samples) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+type HedgerStats struct {
+	Enabled   bool   `json:"enabled"`
+	Calls     uint64 `json:"calls"`
+	Hedges    uint64 `json:"hedges"`
+	HedgeWins uint64 `json:"hedgeWins"`
+}
+
+func (h *Hedger) Stats() HedgerStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HedgerStats{Enabled: h.enabled, Calls: h.calls, Hedges: h.hedges, HedgeWins: h.hedgeWins}
+}
@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"context"
+	"dunlap/app/log"
+	"dunlap/app/mongo"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+const (
+	jobsDatabase         = "honda"
+	jobsCollection       = "rating_jobs"
+	jobResultsCollection = "rating_job_results"
+)
+
+var jobResultsIndexOnce sync.Once
+
+// jobOwner identifies this process in the leases it takes on jobs.
+var jobOwner = uuid.New().String()
+
+// jobLeaseTTL is how long a job stays claimed by its owner without a
+// heartbeat before another replica may take it over.
+func jobLeaseTTL() time.Duration {
+	return envDuration("JOB_LEASE_TTL", time.Minute)
+}
+
+// RatingJob is a batch accepted by POST /rating/jobs. Each finished stop is
+// stored as its own document in rating_job_results, keyed by job ID and the
+// stop's index, so a job can be resumed after a restart by processing only
+// the stops without one and large batches stay under Mongo's document size
+// limit. Results is filled in from there when the job is read.
+type RatingJob struct {
+	ID         string                `json:"id" bson:"_id"`
+	Status     string                `json:"status" bson:"status"`
+	Total      int                   `json:"total" bson:"total"`
+	Completed  int                   `json:"completed" bson:"completed"`
+	Error      string                `json:"error,omitempty" bson:"error,omitempty"`
+	CacheMode  CacheMode             `json:"-" bson:"cacheMode"`
+	Tenant     string                `json:"-" bson:"tenant"`
+	Options    QuoteOptions          `json:"options" bson:"options"`
+	Carriers   CarrierPolicy         `json:"-" bson:"carriers"`
+	Markup     MarkupRules           `json:"-" bson:"markup"`
+	Requests   []PayloadRequest      `json:"-" bson:"requests"`
+	Results    []*ResponseWithStopID `json:"results" bson:"-"`
+	CreatedAt  time.Time             `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time             `json:"updatedAt" bson:"updatedAt"`
+	FinishedAt *time.Time            `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+	// Owner is the replica processing the job, which holds it until
+	// LeaseExpiresAt unless it renews the lease.
+	Owner          string     `json:"-" bson:"owner,omitempty"`
+	LeaseExpiresAt *time.Time `json:"-" bson:"leaseExpiresAt,omitempty"`
+}
+
+// CreateRatingJob persists a new job and starts processing it in the
+// background.
+func CreateRatingJob(ctx context.Context, requests []PayloadRequest, cacheMode CacheMode, tenant string, options QuoteOptions, carriers CarrierPolicy) (*RatingJob, error) {
+	markup, err := LoadMarkupRules(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	leaseExpiresAt := now.Add(jobLeaseTTL())
+	job := &RatingJob{
+		ID:             uuid.New().String(),
+		Status:         JobQueued,
+		Total:          len(requests),
+		CacheMode:      cacheMode,
+		Tenant:         tenant,
+		Options:        options,
+		Carriers:       carriers,
+		Markup:         markup,
+		Requests:       requests,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Owner:          jobOwner,
+		LeaseExpiresAt: &leaseExpiresAt,
+	}
+
+	if err := mongo.InsertDocument(ctx, jobsDatabase, jobsCollection, job); err != nil {
+		return nil, err
+	}
+
+	log.Info("Created rating job %s with %d stops", job.ID, job.Total)
+	go runRatingJob(job)
+	return job, nil
+}
+
+// GetRatingJob loads tenant's job with only the results finished so far.
+// Another tenant's job is reported as not found.
+func GetRatingJob(ctx context.Context, id, tenant string) (*RatingJob, bool, error) {
+	var job RatingJob
+	filter := map[string]interface{}{"_id": id, "tenant": tenant}
+	found, err := mongo.FindDocument(ctx, jobsDatabase, jobsCollection, filter, &job)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	if err := loadRatingJobResults(ctx, &job); err != nil {
+		return nil, true, err
+	}
+
+	finished := make([]*ResponseWithStopID, 0, job.Completed)
+	for _, result := range job.Results {
+		if result != nil {
+			finished = append(finished, result)
+		}
+	}
+	job.Results = finished
+	return &job, true, nil
+}
+
+// ratingJobResult is one finished stop of a job.
+type ratingJobResult struct {
+	ID        string             `bson:"_id"`
+	JobID     string             `bson:"jobId"`
+	Index     int                `bson:"index"`
+	Result    ResponseWithStopID `bson:"result"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+func loadRatingJobResults(ctx context.Context, job *RatingJob) error {
+	var stored []ratingJobResult
+	filter := map[string]interface{}{"jobId": job.ID}
+	if err := mongo.FindDocuments(ctx, jobsDatabase, jobResultsCollection, filter, &stored); err != nil {
+		return err
+	}
+
+	job.Results = make([]*ResponseWithStopID, len(job.Requests))
+	for i := range stored {
+		if index := stored[i].Index; index >= 0 && index < len(job.Results) {
+			job.Results[index] = &stored[i].Result
+		}
+	}
+	return nil
+}
+
+// saveRatingJobResult stores the stop at index and reports whether it had
+// not been stored before.
+func saveRatingJobResult(jobID string, index int, response ResponseWithStopID) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	jobResultsIndexOnce.Do(func() {
+		if err := mongo.EnsureIndex(ctx, jobsDatabase, jobResultsCollection, "jobId", "index"); err != nil {
+			log.Error("Error creating rating job results index: %v", err)
+		}
+	})
+
+	id := fmt.Sprintf("%s:%d", jobID, index)
+	update := map[string]interface{}{
+		"$setOnInsert": map[string]interface{}{"jobId": jobID, "index": index, "result": response, "createdAt": time.Now()},
+	}
+	return mongo.UpsertDocument(ctx, jobsDatabase, jobResultsCollection, map[string]interface{}{"_id": id}, update)
+}
+
+// ResumeRatingJobs claims every unfinished job whose lease has lapsed,
+// because its replica stopped, and runs it here. It checks again every lease
+// period in the background so jobs are picked up from replicas that die
+// later.
+func ResumeRatingJobs() {
+	claimRatingJobs()
+	go func() {
+		ticker := time.NewTicker(jobLeaseTTL())
+		defer ticker.Stop()
+		for range ticker.C {
+			claimRatingJobs()
+		}
+	}()
+}
+
+func claimRatingJobs() {
+	for {
+		job, err := claimRatingJob()
+		if err != nil {
+			log.Error("Error claiming unfinished rating jobs: %v", err)
+			return
+		}
+		if job == nil {
+			return
+		}
+		log.Info("Resuming rating job %s (%d/%d stops done)", job.ID, job.Completed, job.Total)
+		go runRatingJob(job)
+	}
+}
+
+// claimRatingJob atomically takes the lease on one unfinished job that no
+// replica holds, so each job runs in exactly one place.
+func claimRatingJob() (*RatingJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := map[string]interface{}{
+		"status": map[string]interface{}{"$in": []string{JobQueued, JobRunning}},
+		"$or": []map[string]interface{}{
+			{"leaseExpiresAt": map[string]interface{}{"$exists": false}},
+			{"leaseExpiresAt": map[string]interface{}{"$lt": now}},
+		},
+	}
+	update := map[string]interface{}{
+		"$set": map[string]interface{}{"owner": jobOwner, "leaseExpiresAt": now.Add(jobLeaseTTL())},
+	}
+
+	var job RatingJob
+	found, err := mongo.FindAndUpdateDocument(ctx, jobsDatabase, jobsCollection, filter, update, &job)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// renewJobLease extends this replica's lease on the job and reports whether
+// it still held it.
+func renewJobLease(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := map[string]interface{}{"_id": id, "owner": jobOwner}
+	update := map[string]interface{}{
+		"$set": map[string]interface{}{"leaseExpiresAt": time.Now().Add(jobLeaseTTL())},
+	}
+	var job RatingJob
+	return mongo.FindAndUpdateDocument(ctx, jobsDatabase, jobsCollection, filter, update, &job)
+}
+
+// heartbeatRatingJob renews the job's lease until ctx is done. If another
+// replica has taken the job over it calls lost and stops.
+func heartbeatRatingJob(ctx context.Context, id string, lost func()) {
+	ticker := time.NewTicker(jobLeaseTTL() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			held, err := renewJobLease(id)
+			if err != nil {
+				log.Error("Error renewing lease on rating job %s: %v", id, err)
+				continue
+			}
+			if !held {
+				log.Warning("Lost lease on rating job %s, stopping", id)
+				lost()
+				return
+			}
+		}
+	}
+}
+
+func runRatingJob(job *RatingJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var leaseLost atomic.Bool
+	go heartbeatRatingJob(ctx, job.ID, func() {
+		leaseLost.Store(true)
+		cancel()
+	})
+
+	if err := loadRatingJobResults(ctx, job); err != nil {
+		log.Error("Rating job %s failed loading results: %v", job.ID, err)
+		updateRatingJob(job.ID, map[string]interface{}{"status": JobFailed, "error": err.Error()})
+		return
+	}
+
+	var pending []PayloadRequest
+	var slots []int
+	for i, request := range job.Requests {
+		if i >= len(job.Results) || job.Results[i] == nil {
+			pending = append(pending, request)
+			slots = append(slots, i)
+		}
+	}
+
+	processor, err := NewRequestProcessor()
+	if err != nil {
+		log.Error("Rating job %s failed: %v", job.ID, err)
+		updateRatingJob(job.ID, map[string]interface{}{"status": JobFailed, "error": err.Error()})
+		return
+	}
+	processor.Cache = job.CacheMode
+	processor.Tenant = job.Tenant
+	processor.Options = job.Options
+	processor.Carriers = job.Carriers
+	processor.Markup = job.Markup
+	// A result that cannot be stored would leave the job running forever, so
+	// the first failed save stops the job and marks it failed.
+	var saveErr error
+	processor.OnResult = func(index int, response ResponseWithStopID) {
+		// Stops abandoned because the job was stopped are left for whoever
+		// runs it next.
+		if saveErr != nil || ctx.Err() != nil {
+			return
+		}
+		inserted, err := saveRatingJobResult(job.ID, slots[index], response)
+		if err == nil && inserted {
+			err = saveRatingJob(job.ID, map[string]interface{}{
+				"$set": map[string]interface{}{"updatedAt": time.Now()},
+				"$inc": map[string]interface{}{"completed": 1},
+			})
+		}
+		if err != nil {
+			saveErr = fmt.Errorf("saving stop %d: %w", slots[index], err)
+			cancel()
+		}
+	}
+
+	updateRatingJob(job.ID, map[string]interface{}{"status": JobRunning})
+
+	_, err = processor.ProcessRequestsInParallel(ctx, pending)
+	if leaseLost.Load() {
+		return
+	}
+	if err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		log.Error("Rating job %s failed: %v", job.ID, err)
+		updateRatingJob(job.ID, map[string]interface{}{"status": JobFailed, "error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	updateRatingJob(job.ID, map[string]interface{}{"status": JobCompleted, "finishedAt": now})
+	log.Info("Rating job %s completed", job.ID)
+}
+
+func updateRatingJob(id string, fields map[string]interface{}) {
+	fields["updatedAt"] = time.Now()
+	saveRatingJob(id, map[string]interface{}{"$set": fields})
+}
+
+func saveRatingJob(id string, update map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := mongo.UpdateDocument(ctx, jobsDatabase, jobsCollection, map[string]interface{}{"_id": id}, update)
+	if err != nil {
+		log.Error("Error saving rating job %s: %v", id, err)
+	}
+	return err
+}
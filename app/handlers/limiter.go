@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ErrorCodeOverloaded = "OVERLOADED"
+
+var ErrOverloaded = errors.New("upstream wait queue is full")
+
+type limiterWaiter struct {
+	tenant  string
+	ready   chan struct{}
+	granted bool
+}
+
+// ConcurrencyLimiter caps the number of upstream calls in flight across the
+// whole process. Each tenant may hold at most its share of the slots, and
+// callers that cannot get a slot wait in a bounded FIFO queue.
+type ConcurrencyLimiter struct {
+	mu           sync.Mutex
+	capacity     int
+	shares       map[string]float64
+	defaultShare float64
+	maxQueue     int
+	retryAfter   time.Duration
+	inUse        int
+	tenantInUse  map[string]int
+	waiters      *list.List
+	shed         uint64
+}
+
+// Limiter bounds upstream concurrency for every RequestProcessor.
+var Limiter = NewConcurrencyLimiter(20, nil, 1, 200, 5*time.Second)
+
+func NewConcurrencyLimiter(capacity int, shares map[string]float64, defaultShare float64, maxQueue int, retryAfter time.Duration) *ConcurrencyLimiter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if shares == nil {
+		shares = map[string]float64{}
+	}
+	return &ConcurrencyLimiter{
+		capacity:     capacity,
+		shares:       shares,
+		defaultShare: defaultShare,
+		maxQueue:     maxQueue,
+		retryAfter:   retryAfter,
+		tenantInUse:  make(map[string]int),
+		waiters:      list.New(),
+	}
+}
+
+// LoadConcurrencyLimiter reads UPSTREAM_TENANT_SHARES as a comma separated
+// list of tenant=fraction pairs, e.g. "dealers=0.5,parts=0.25".
+func LoadConcurrencyLimiter() *ConcurrencyLimiter {
+	shares := map[string]float64{}
+	for _, pair := range strings.Split(os.Getenv("UPSTREAM_TENANT_SHARES"), ",") {
+		tenant, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		if share, err := strconv.ParseFloat(value, 64); err == nil && share > 0 {
+			shares[strings.TrimSpace(tenant)] = share
+		}
+	}
+	return NewConcurrencyLimiter(
+		envInt("UPSTREAM_CONCURRENCY", 20),
+		shares,
+		envFloat("UPSTREAM_TENANT_DEFAULT_SHARE", 1),
+		envInt("UPSTREAM_MAX_QUEUE", 200),
+		envDuration("UPSTREAM_SHED_RETRY_AFTER", 5*time.Second),
+	)
+}
+
+func (l *ConcurrencyLimiter) tenantLimitLocked(tenant string) int {
+	share, ok := l.shares[tenant]
+	if !ok {
+		share = l.defaultShare
+	}
+	limit := int(math.Ceil(share * float64(l.capacity)))
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+func (l *ConcurrencyLimiter) canRunLocked(tenant string) bool {
+	return l.inUse < l.capacity && l.tenantInUse[tenant] < l.tenantLimitLocked(tenant)
+}
+
+func (l *ConcurrencyLimiter) grantLocked(tenant string) {
+	l.inUse++
+	l.tenantInUse[tenant]++
+}
+
+// Acquire blocks until tenant may start an upstream call and returns the
+// function that gives the slot back, along with how long the caller queued.
+// It fails with ErrOverloaded when the wait queue is already full.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, tenant string) (func(), time.Duration, error) {
+	start := time.Now()
+
+	l.mu.Lock()
+	if l.canRunLocked(tenant) {
+		l.grantLocked(tenant)
+		l.mu.Unlock()
+		return l.releaser(tenant), 0, nil
+	}
+	if l.waiters.Len() >= l.maxQueue {
+		l.shed++
+		l.mu.Unlock()
+		return nil, 0, ErrOverloaded
+	}
+	waiter := &limiterWaiter{tenant: tenant, ready: make(chan struct{})}
+	element := l.waiters.PushBack(waiter)
+	l.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return l.releaser(tenant), time.Since(start), nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		granted := waiter.granted
+		if !granted {
+			l.waiters.Remove(element)
+		}
+		l.mu.Unlock()
+		if granted {
+			l.releaser(tenant)()
+		}
+		return nil, time.Since(start), ctx.Err()
+	}
+}
+
+// TryAcquire takes a slot for tenant only if one is free right now and no
+// one is queued ahead, for optional work such as hedged calls.
+func (l *ConcurrencyLimiter) TryAcquire(tenant string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.waiters.Len() > 0 || !l.canRunLocked(tenant) {
+		return nil, false
+	}
+	l.grantLocked(tenant)
+	return l.releaser(tenant), true
+}
+
+func (l *ConcurrencyLimiter) releaser(tenant string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.inUse--
+			l.tenantInUse[tenant]--
+			if l.tenantInUse[tenant] == 0 {
+				delete(l.tenantInUse, tenant)
+			}
+			l.dispatchLocked()
+		})
+	}
+}
+
+// dispatchLocked hands free slots to the oldest waiters whose tenant is
+// still under its share.
+func (l *ConcurrencyLimiter) dispatchLocked() {
+	for element := l.waiters.Front(); element != nil && l.inUse < l.capacity; {
+		next := element.Next()
+		waiter := element.Value.(*limiterWaiter)
+		if l.canRunLocked(waiter.tenant) {
+			l.grantLocked(waiter.tenant)
+			waiter.granted = true
+			close(waiter.ready)
+			l.waiters.Remove(element)
+		}
+		element = next
+	}
+}
+
+// Overloaded reports whether new work should be shed, and if so how long the
+// client should wait before retrying.
+func (l *ConcurrencyLimiter) Overloaded() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiters.Len() >= l.maxQueue, l.retryAfter
+}
+
+type LimiterStats struct {
+	Capacity int            `json:"capacity"`
+	InUse    int            `json:"inUse"`
+	Queued   int            `json:"queued"`
+	MaxQueue int            `json:"maxQueue"`
+	Shed     uint64         `json:"shed"`
+	Tenants  map[string]int `json:"tenants"`
+}
+
+func (l *ConcurrencyLimiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tenants := make(map[string]int, len(l.tenantInUse))
+	for tenant, n := range l.tenantInUse {
+		tenants[tenant] = n
+	}
+	return LimiterStats{
+		Capacity: l.capacity,
+		InUse:    l.inUse,
+		Queued:   l.waiters.Len(),
+		MaxQueue: l.maxQueue,
+		Shed:     l.shed,
+		Tenants:  tenants,
+	}
+}
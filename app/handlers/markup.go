@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"dunlap/app/mongo"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	MarkupPercentage    = "percentage"
+	MarkupFlat          = "flat"
+	MarkupMinimumMargin = "minimumMargin"
+)
+
+const (
+	markupDatabase   = "honda"
+	markupCollection = "markup_rules"
+)
+
+// MarkupMatch limits a rule to quotes meeting every non-empty condition.
+// Zip entries are prefixes, so "231" matches every ZIP starting with 231.
+type MarkupMatch struct {
+	Scacs           []string `json:"scacs,omitempty" bson:"scacs,omitempty"`
+	ServiceTypes    []string `json:"serviceTypes,omitempty" bson:"serviceTypes,omitempty"`
+	ShipmentModes   []string `json:"shipmentModes,omitempty" bson:"shipmentModes,omitempty"`
+	OriginZips      []string `json:"originZips,omitempty" bson:"originZips,omitempty"`
+	DestinationZips []string `json:"destinationZips,omitempty" bson:"destinationZips,omitempty"`
+}
+
+// MarkupRule adjusts the billed amount of matching quotes. Percentage and
+// flat rules add to the price; a minimumMargin rule raises the price so it
+// is at least Value above the carrier cost. Rules run in Priority order and
+// all matching rules apply unless one sets Final.
+type MarkupRule struct {
+	ID       string      `json:"id" bson:"_id"`
+	Tenant   string      `json:"tenant" bson:"tenant"`
+	Priority int         `json:"priority" bson:"priority"`
+	Type     string      `json:"type" bson:"type"`
+	Value    float64     `json:"value" bson:"value"`
+	Match    MarkupMatch `json:"match" bson:"match"`
+	Final    bool        `json:"final,omitempty" bson:"final,omitempty"`
+	Disabled bool        `json:"disabled,omitempty" bson:"disabled,omitempty"`
+}
+
+type MarkupRules []MarkupRule
+
+// LoadMarkupRules returns the tenant's enabled rules in the order they run.
+func LoadMarkupRules(ctx context.Context, tenant string) (MarkupRules, error) {
+	var rules MarkupRules
+	filter := map[string]interface{}{"tenant": tenant, "disabled": map[string]interface{}{"$ne": true}}
+	if err := mongo.FindDocuments(ctx, markupDatabase, markupCollection, filter, &rules); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority < rules[j].Priority })
+	return rules, nil
+}
+
+// Apply marks up every quote in response, keeping the carrier's own price in
+// CarrierCost and the IDs of the rules that changed it in AppliedRules.
+func (rules MarkupRules) Apply(response *ResponseWithStopID, details FreightDetails) {
+	if len(rules) == 0 {
+		return
+	}
+
+	for i := range response.Response {
+		quote := &response.Response[i]
+		cost := quote.Billed
+		price := cost
+		var applied []string
+
+		for _, rule := range rules {
+			if !rule.Match.matches(*quote, details) {
+				continue
+			}
+
+			before := price
+			switch rule.Type {
+			case MarkupPercentage:
+				price += cost * rule.Value / 100
+			case MarkupFlat:
+				price += rule.Value
+			case MarkupMinimumMargin:
+				price = math.Max(price, cost+rule.Value)
+			}
+			if price != before {
+				applied = append(applied, rule.ID)
+			}
+			if rule.Final {
+				break
+			}
+		}
+
+		quote.CarrierCost = cost
+		quote.Billed = math.Round(price*100) / 100
+		quote.AppliedRules = applied
+	}
+}
+
+func (m MarkupMatch) matches(quote APIResponseItem, details FreightDetails) bool {
+	if len(m.Scacs) > 0 && !containsCode(m.Scacs, quote.Scac) {
+		return false
+	}
+	if len(m.ServiceTypes) > 0 && !containsCode(m.ServiceTypes, quote.ServiceType) {
+		return false
+	}
+	if len(m.ShipmentModes) > 0 && !containsCode(m.ShipmentModes, details.ShipmentMode) {
+		return false
+	}
+	if len(m.OriginZips) > 0 && !hasZipPrefix(m.OriginZips, details.ShipperZip) {
+		return false
+	}
+	if len(m.DestinationZips) > 0 && !hasZipPrefix(m.DestinationZips, details.ConsigneeZip) {
+		return false
+	}
+	return true
+}
+
+func hasZipPrefix(prefixes []string, zip string) bool {
+	zip = normalizePostalCode(zip)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(zip, normalizePostalCode(prefix)) {
+			return true
+		}
+	}
+	return false
+}
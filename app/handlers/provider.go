@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"dunlap/app/log"
+	"os"
+	"strings"
+)
+
+// RateProvider quotes a single stop against one rating source. Adapters only
+// talk to their upstream; the processor wraps every call with the quote
+// cache, coalescing, retries, the concurrency limiter and hedging, and tags
+// the quotes it returns with Name.
+type RateProvider interface {
+	Name() string
+	Rate(ctx context.Context, req PayloadRequest) ([]APIResponseItem, error)
+}
+
+// ProviderStatus reports how one provider fared for a stop that was rated by
+// more than one.
+type ProviderStatus struct {
+	Provider  string `json:"provider"`
+	Quotes    int    `json:"quotes"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+var providerFactories = map[string]func() (RateProvider, error){
+	RevConProviderName: NewRevConProvider,
+}
+
+// RegisterProvider makes a provider available to RATE_PROVIDERS under name.
+// It must be called before InitializeUpstream.
+func RegisterProvider(name string, factory func() (RateProvider, error)) {
+	providerFactories[strings.ToLower(name)] = factory
+}
+
+// RateProviders are the providers every stop is fanned out to. They are set
+// by InitializeUpstream.
+var RateProviders []RateProvider
+
+// LoadRateProviders builds the providers named in RATE_PROVIDERS, a comma
+// separated list that defaults to "revcon". Unknown or misconfigured
+// providers are logged and left out.
+func LoadRateProviders() []RateProvider {
+	names := os.Getenv("RATE_PROVIDERS")
+	if strings.TrimSpace(names) == "" {
+		names = RevConProviderName
+	}
+
+	var providers []RateProvider
+	seen := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		factory, ok := providerFactories[name]
+		if !ok {
+			log.Error("Unknown rate provider %q in RATE_PROVIDERS", name)
+			continue
+		}
+		provider, err := factory()
+		if err != nil {
+			log.Error("Rate provider %q is disabled: %v", name, err)
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+// mergeProviderResults combines each provider's response for a stop. The
+// stop only reports an error when every provider failed.
+func mergeProviderResults(stopID int, providers []RateProvider, results []ResponseWithStopID) ResponseWithStopID {
+	stop := ResponseWithStopID{StopID: stopID}
+	var failure *ResponseWithStopID
+	succeeded := 0
+
+	for i, result := range results {
+		name := providers[i].Name()
+		if result.Error == "" {
+			succeeded++
+			if stop.Response == nil {
+				stop.Response = []APIResponseItem{}
+			}
+		} else if failure == nil {
+			failure = &results[i]
+		}
+
+		for _, quote := range result.Response {
+			quote.Provider = name
+			stop.Response = append(stop.Response, quote)
+		}
+
+		stop.Attempts += result.Attempts
+		if result.QueueWaitMs > stop.QueueWaitMs {
+			stop.QueueWaitMs = result.QueueWaitMs
+		}
+		// A stop only counts as a cache hit when every provider's quotes were.
+		if i == 0 || result.Cache != CacheHit {
+			stop.Cache = result.Cache
+		}
+		stop.Coalesced = stop.Coalesced || result.Coalesced
+		stop.Hedged = stop.Hedged || result.Hedged
+
+		if len(results) > 1 {
+			stop.Providers = append(stop.Providers, ProviderStatus{
+				Provider:  name,
+				Quotes:    len(result.Response),
+				Error:     result.Error,
+				ErrorCode: result.ErrorCode,
+			})
+		}
+	}
+
+	if succeeded == 0 && failure != nil {
+		stop.Error = failure.Error
+		stop.ErrorCode = failure.ErrorCode
+	}
+	return stop
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"dunlap/app/log"
+	"dunlap/app/mongo"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache statuses reported per stop in ResponseWithStopID.Cache.
+const (
+	CacheHit    = "hit"
+	CacheMiss   = "miss"
+	CacheBypass = "bypass"
+)
+
+// CacheMode is how a batch uses the quote cache, taken from the request's
+// Cache-Control header.
+type CacheMode int
+
+const (
+	// CacheDefault reads from and writes to the cache.
+	CacheDefault CacheMode = iota
+	// CacheRefresh (no-cache) skips the lookup but stores the fresh quote.
+	CacheRefresh
+	// CacheNoStore (no-store) neither reads nor writes the cache.
+	CacheNoStore
+)
+
+func CacheModeFromRequest(r *http.Request) CacheMode {
+	mode := CacheDefault
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store":
+			return CacheNoStore
+		case "no-cache":
+			mode = CacheRefresh
+		}
+	}
+	return mode
+}
+
+type quoteEntry struct {
+	key       string
+	items     []APIResponseItem
+	expiresAt time.Time
+}
+
+// QuoteCache keeps recent quotes keyed by provider and QuoteKey in an
+// in-memory LRU, optionally backed by a Mongo collection shared between
+// replicas.
+type QuoteCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	shared  bool
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+const (
+	quoteCacheDatabase   = "honda"
+	quoteCacheCollection = "quote_cache"
+)
+
+// Quotes is the process-wide quote cache. It stays disabled until
+// InitializeUpstream configures it.
+var Quotes = NewQuoteCache(0, 0, false)
+
+func NewQuoteCache(ttl time.Duration, size int, shared bool) *QuoteCache {
+	return &QuoteCache{
+		ttl:     ttl,
+		size:    size,
+		shared:  shared,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func LoadQuoteCache() *QuoteCache {
+	return NewQuoteCache(
+		envDuration("QUOTE_CACHE_TTL", 15*time.Minute),
+		envInt("QUOTE_CACHE_SIZE", 1000),
+		envBool("QUOTE_CACHE_MONGO", false),
+	)
+}
+
+func (c *QuoteCache) Enabled() bool {
+	return c.ttl > 0 && c.size > 0
+}
+
+// Get returns a copy of the cached quote for key.
+func (c *QuoteCache) Get(ctx context.Context, key string) ([]APIResponseItem, bool) {
+	if items, ok := c.getLocal(key); ok {
+		return items, true
+	}
+	if !c.shared {
+		return nil, false
+	}
+
+	raw, found, err := mongo.FindCachedQuote(ctx, quoteCacheDatabase, quoteCacheCollection, key)
+	if err != nil {
+		log.Error("Error reading shared quote cache: %v", err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+
+	var items []APIResponseItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		log.Error("Error decoding shared quote cache entry: %v", err)
+		return nil, false
+	}
+	c.setLocal(key, items)
+	return copyQuote(items), true
+}
+
+// Set stores a copy of items under key in every enabled tier.
+func (c *QuoteCache) Set(ctx context.Context, key string, items []APIResponseItem) {
+	c.setLocal(key, items)
+	if !c.shared {
+		return
+	}
+
+	raw, err := json.Marshal(items)
+	if err != nil {
+		log.Error("Error encoding quote for shared cache: %v", err)
+		return
+	}
+	if err := mongo.StoreCachedQuote(ctx, quoteCacheDatabase, quoteCacheCollection, key, raw, time.Now().Add(c.ttl)); err != nil {
+		log.Error("Error writing shared quote cache: %v", err)
+	}
+}
+
+func (c *QuoteCache) getLocal(key string) ([]APIResponseItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*quoteEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return copyQuote(entry.items), true
+}
+
+func (c *QuoteCache) setLocal(key string, items []APIResponseItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &quoteEntry{key: key, items: copyQuote(items), expiresAt: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*quoteEntry).key)
+	}
+}
+
+func copyQuote(items []APIResponseItem) []APIResponseItem {
+	if items == nil {
+		return nil
+	}
+	out := make([]APIResponseItem, len(items))
+	copy(out, items)
+	return out
+}
+
+// QuoteKey hashes a canonical form of details so that requests differing
+// only in letter case, whitespace, accessorial order or item order share a
+// cache entry.
+func QuoteKey(details FreightDetails) string {
+	normalized := details
+	normalized.ConsigneeZip = normalizePostalCode(details.ConsigneeZip)
+	normalized.ShipperZip = normalizePostalCode(details.ShipperZip)
+	normalized.ShipmentMode = normalizeCode(details.ShipmentMode)
+	normalized.ShipperCountry = normalizeCode(details.ShipperCountry)
+	normalized.ConsigneeCountry = normalizeCode(details.ConsigneeCountry)
+	normalized.EquipmentType = normalizeCode(details.EquipmentType)
+	normalized.Miles = strings.TrimSpace(details.Miles)
+
+	seen := make(map[string]bool, len(details.Accessorials))
+	normalized.Accessorials = make([]string, 0, len(details.Accessorials))
+	for _, code := range details.Accessorials {
+		code = normalizeCode(code)
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+		normalized.Accessorials = append(normalized.Accessorials, code)
+	}
+	sort.Strings(normalized.Accessorials)
+
+	items := make([]string, 0, len(details.Items))
+	for _, item := range details.Items {
+		item.Class = strings.TrimSpace(item.Class)
+		item.Packaging = strings.ToLower(strings.TrimSpace(item.Packaging))
+		item.ProductDescription = strings.TrimSpace(item.ProductDescription)
+		item.Density = strings.TrimSpace(item.Density)
+		item.UnitsWeight = strings.ToLower(strings.TrimSpace(item.UnitsWeight))
+		item.UnitsDensity = strings.ToLower(strings.TrimSpace(item.UnitsDensity))
+		item.UnitsDimension = strings.ToLower(strings.TrimSpace(item.UnitsDimension))
+		encoded, _ := json.Marshal(item)
+		items = append(items, string(encoded))
+	}
+	sort.Strings(items)
+	normalized.Items = nil
+
+	encoded, _ := json.Marshal(struct {
+		Details FreightDetails `json:"details"`
+		Items   []string       `json:"items"`
+	}{normalized, items})
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeCode(value string) string {
+	return strings.ToUpper(strings.TrimSpace(value))
+}
+
+func normalizePostalCode(value string) string {
+	return strings.ReplaceAll(normalizeCode(value), " ", "")
+}
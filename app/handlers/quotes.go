@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SortByBilled  = "billed"
+	SortByTransit = "transit"
+)
+
+// QuoteOptions narrows and orders the quotes returned for each stop. They are
+// read from the rating request's query string:
+//
+//	sort=billed|transit  order=asc|desc  scac=ABCD,EFGH
+//	serviceType=STD,GTD  maxTransitDays=3  limit=5  debug=true
+type QuoteOptions struct {
+	SortBy         string   `json:"sortBy,omitempty"`
+	Descending     bool     `json:"descending,omitempty"`
+	Scacs          []string `json:"scacs,omitempty"`
+	ServiceTypes   []string `json:"serviceTypes,omitempty"`
+	MaxTransitDays int      `json:"maxTransitDays,omitempty"`
+	Limit          int      `json:"limit,omitempty"`
+	Debug          bool     `json:"debug,omitempty"`
+}
+
+func ParseQuoteOptions(r *http.Request) (QuoteOptions, error) {
+	query := r.URL.Query()
+	var opts QuoteOptions
+
+	switch sortBy := strings.ToLower(query.Get("sort")); sortBy {
+	case "", SortByBilled, SortByTransit:
+		opts.SortBy = sortBy
+	default:
+		return opts, fmt.Errorf("invalid sort %q: expected %s or %s", sortBy, SortByBilled, SortByTransit)
+	}
+
+	switch order := strings.ToLower(query.Get("order")); order {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("invalid order %q: expected asc or desc", order)
+	}
+
+	opts.Debug = query.Get("debug") == "true"
+	opts.Scacs = splitList(query.Get("scac"))
+	opts.ServiceTypes = splitList(query.Get("serviceType"))
+
+	for name, target := range map[string]*int{"maxTransitDays": &opts.MaxTransitDays, "limit": &opts.Limit} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid %s %q: expected a positive integer", name, value)
+		}
+		*target = n
+	}
+
+	return opts, nil
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = normalizeCode(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// Apply filters, sorts and trims response.Response in place and records the
+// cheapest and fastest of the quotes that passed the filters.
+func (o QuoteOptions) Apply(response *ResponseWithStopID) {
+	if len(response.Response) == 0 {
+		return
+	}
+
+	quotes := make([]APIResponseItem, 0, len(response.Response))
+	for _, quote := range response.Response {
+		if o.keep(quote) {
+			quotes = append(quotes, quote)
+		}
+	}
+
+	response.Cheapest, response.Fastest = nil, nil
+	fastestDays := 0
+	for i := range quotes {
+		quote := quotes[i]
+		if response.Cheapest == nil || quote.Billed < response.Cheapest.Billed {
+			response.Cheapest = &quote
+		}
+		days, ok := transitDays(quote.TransitTime)
+		if !ok {
+			continue
+		}
+		if response.Fastest == nil || days < fastestDays || (days == fastestDays && quote.Billed < response.Fastest.Billed) {
+			response.Fastest = &quote
+			fastestDays = days
+		}
+	}
+
+	switch o.SortBy {
+	case SortByBilled:
+		sort.SliceStable(quotes, func(i, j int) bool {
+			if o.Descending {
+				return quotes[i].Billed > quotes[j].Billed
+			}
+			return quotes[i].Billed < quotes[j].Billed
+		})
+	case SortByTransit:
+		sort.SliceStable(quotes, func(i, j int) bool {
+			a, b := transitSortKey(quotes[i]), transitSortKey(quotes[j])
+			if o.Descending {
+				return a > b
+			}
+			return a < b
+		})
+	}
+
+	if o.Limit > 0 && len(quotes) > o.Limit {
+		quotes = quotes[:o.Limit]
+	}
+	response.Response = quotes
+}
+
+func (o QuoteOptions) keep(quote APIResponseItem) bool {
+	if len(o.Scacs) > 0 && !containsCode(o.Scacs, quote.Scac) {
+		return false
+	}
+	if len(o.ServiceTypes) > 0 && !containsCode(o.ServiceTypes, quote.ServiceType) {
+		return false
+	}
+	if o.MaxTransitDays > 0 {
+		days, ok := transitDays(quote.TransitTime)
+		if !ok || days > o.MaxTransitDays {
+			return false
+		}
+	}
+	return true
+}
+
+func containsCode(codes []string, value string) bool {
+	value = normalizeCode(value)
+	for _, code := range codes {
+		if code == value {
+			return true
+		}
+	}
+	return false
+}
+
+// transitSortKey orders quotes without a parseable transit time last.
+func transitSortKey(quote APIResponseItem) int {
+	if days, ok := transitDays(quote.TransitTime); ok {
+		return days
+	}
+	return int(^uint(0) >> 1)
+}
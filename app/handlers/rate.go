@@ -5,6 +5,7 @@ import (
 	"context"
 	"dunlap/app/log"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -20,16 +21,47 @@ var (
 	MaxWorkers   = 5
 )
 
+// upstreamTimeout bounds one rating call to a provider, retries included.
+const upstreamTimeout = 69 * time.Second
+
 type RequestProcessor struct {
-	AccessToken string
-	Headers     map[string]string
-	Workers     int
+	Providers []RateProvider
+	Workers   int
+	Retry     RetryPolicy
+	Cache     CacheMode
+	Tenant    string
+	Options   QuoteOptions
+	Carriers  CarrierPolicy
+	Markup    MarkupRules
+	// OnResult, when set, is called with each stop's response as soon as it
+	// is ready, from the goroutine running ProcessRequestsInParallel.
+	OnResult func(index int, response ResponseWithStopID)
 }
 
+// Error codes reported per stop in ResponseWithStopID.ErrorCode.
+const (
+	ErrorCodeUpstreamUnavailable = "UPSTREAM_UNAVAILABLE"
+	ErrorCodeTimeout             = "TIMEOUT"
+	ErrorCodeCancelled           = "CANCELLED"
+)
+
 type ResponseWithStopID struct {
-	StopID   int               `json:"stopId"`
-	Response []APIResponseItem `json:"response"`
-	Error    string            `json:"error,omitempty"`
+	StopID         int                  `json:"stopId"`
+	OriginalStopID *int                 `json:"originalStopId,omitempty"`
+	Response       []APIResponseItem    `json:"response"`
+	Error          string               `json:"error,omitempty"`
+	ErrorCode      string               `json:"errorCode,omitempty"`
+	Attempts       int                  `json:"attempts"`
+	QueueWaitMs    int64                `json:"queueWaitMs"`
+	Cache          string               `json:"cache,omitempty"`
+	Coalesced      bool                 `json:"coalesced,omitempty"`
+	Hedged         bool                 `json:"hedged,omitempty"`
+	Providers      []ProviderStatus     `json:"providers,omitempty"`
+	Cheapest       *APIResponseItem     `json:"cheapest,omitempty"`
+	Fastest        *APIResponseItem     `json:"fastest,omitempty"`
+	Debug          *StopDebug           `json:"debug,omitempty"`
+	Violations     []Violation          `json:"violations,omitempty"`
+	Classification []ItemClassification `json:"classification,omitempty"`
 }
 
 type FreightRequest struct {
@@ -37,8 +69,12 @@ type FreightRequest struct {
 }
 
 type PayloadRequest struct {
-	StopId         int            `json:"stopId"`
-	FreightDetails FreightDetails `json:"freightDetails"`
+	StopId         int                  `json:"stopId"`
+	ShipDate       string               `json:"shipDate,omitempty"`
+	OriginalStopId *int                 `json:"-"`
+	Violations     []Violation          `json:"-"`
+	Classification []ItemClassification `json:"-"`
+	FreightDetails FreightDetails       `json:"freightDetails"`
 }
 
 type FreightDetails struct {
@@ -76,14 +112,31 @@ type OrderProcessingError struct {
 	Message string
 }
 
+// StatusError is returned by PostRequestWithContext when upstream answers
+// with anything other than 200.
+type StatusError struct {
+	StatusCode int
+	Body       string
+	Header     http.Header
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non-200 HTTP status code received: %d, body: %s", e.StatusCode, e.Body)
+}
+
 type APIResponseItem struct {
-	Name               string  `json:"name"`
-	Scac               string  `json:"scac"`
-	Billed             float64 `json:"billed"`
-	TransitTime        string  `json:"transitTime"`
-	BillToCode         *int    `json:"billToCode,omitempty"`
-	ServiceType        string  `json:"serviceType"`
-	ServiceDescription string  `json:"serviceDescription"`
+	Name               string   `json:"name"`
+	Scac               string   `json:"scac"`
+	Billed             float64  `json:"billed"`
+	TransitTime        string   `json:"transitTime"`
+	BillToCode         *int     `json:"billToCode,omitempty"`
+	ServiceType        string   `json:"serviceType"`
+	ServiceDescription string   `json:"serviceDescription"`
+	CarrierCost        float64  `json:"carrierCost,omitempty"`
+	AppliedRules       []string `json:"appliedRules,omitempty"`
+	TransitDays        *int     `json:"transitDays,omitempty"`
+	EstimatedDelivery  string   `json:"estimatedDelivery,omitempty"`
+	Provider           string   `json:"provider,omitempty"`
 }
 
 func PostRequestWithContext(ctx context.Context, client *http.Client, url string, headers map[string]string, jsonPayload map[string]interface{}, stopID int) (string, error) {
@@ -109,8 +162,7 @@ func PostRequestWithContext(ctx context.Context, client *http.Client, url string
 		req.Header.Set(key, value)
 	}
 
-	    // Log the request body for debugging, ensure sensitive information is not logged
-	
+	// Log the request body for debugging, ensure sensitive information is not logged
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -122,11 +174,10 @@ func PostRequestWithContext(ctx context.Context, client *http.Client, url string
 
 	responseBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-	    log.Error("[StopID: %d] Error reading response body: %v", stopID, err)
-	    return "", err
+		log.Error("[StopID: %d] Error reading response body: %v", stopID, err)
+		return "", err
 	}
 
-
 	if err != nil {
 		log.Error("%d, REVCON RESPONSE: %s", resp.StatusCode, responseBody)
 
@@ -135,14 +186,13 @@ func PostRequestWithContext(ctx context.Context, client *http.Client, url string
 	}
 	stringJson := string(jsonData)
 	if resp.StatusCode != http.StatusOK {
-	    log.Error("[UUID: %v] [StopID: %d] Non-200 HTTP status code: %v, Payload: %s, Response Body: %s | End of Log - Debug ", requestID, stopID, resp.StatusCode, stringJson, responseBody)
-	    
-	    err = fmt.Errorf("non-200 HTTP status code received: %d, body: %s", resp.StatusCode, responseBody)
-	    return "", err
+		log.Error("[UUID: %v] [StopID: %d] Non-200 HTTP status code: %v, Payload: %s, Response Body: %s | End of Log - Debug ", requestID, stopID, resp.StatusCode, stringJson, responseBody)
+
+		return "", &StatusError{StatusCode: resp.StatusCode, Body: string(responseBody), Header: resp.Header}
 	}
-	
+
 	log.Info("Status Code: %v, [UUID: %v] [StopID: %d] ", resp.StatusCode, requestID, stopID)
-	
+
 	return string(responseBody), nil
 }
 
@@ -163,45 +213,38 @@ func LoadJSONFile(filePath string) (map[string]interface{}, error) {
 }
 
 func ParseRequests(r *http.Request) ([]PayloadRequest, error) {
-    body, err := ioutil.ReadAll(r.Body)
-    if err != nil {
-        return nil, err
-    }
-    defer r.Body.Close()
-
-    var requests []PayloadRequest
-    if err := json.Unmarshal(body, &requests); err != nil {
-        return nil, err
-    }
-
-    // Log the body of the request
-    log.Info("Origin Requests Body: %s", string(body))
-
-    // Log headers of the request
-    log.Info("Request Headers:")
-    for name, values := range r.Header {
-        // Loop over all values for the name.
-        for _, value := range values {
-            log.Info("%s: %s", name, value)
-        }
-    }
-
-    return requests, nil
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	var requests []PayloadRequest
+	if err := json.Unmarshal(body, &requests); err != nil {
+		return nil, err
+	}
+
+	disambiguate := r.URL.Query().Get("disambiguateStopIds") == "true"
+	if err := checkStopIDs(body, requests, disambiguate); err != nil {
+		return nil, err
+	}
+
+	// Log the body of the request. Headers are not logged, since they carry
+	// the caller's API key.
+	log.Info("Origin Requests Body: %s", string(body))
+
+	return requests, nil
 }
 
 func NewRequestProcessor() (*RequestProcessor, error) {
-	accessToken, err := GetOAuthToken()
-	if err != nil {
-		return nil, err
+	if len(RateProviders) == 0 {
+		return nil, errors.New("no rate providers are enabled")
 	}
 
 	return &RequestProcessor{
-		AccessToken: accessToken,
-		Headers: map[string]string{
-			"Authorization": fmt.Sprintf("Bearer %s", accessToken),
-			"Content-Type":  "application/json",
-		},
-		Workers: MaxWorkers,
+		Providers: RateProviders,
+		Workers:   MaxWorkers,
+		Retry:     LoadRetryPolicy(),
 	}, nil
 }
 
@@ -210,54 +253,134 @@ func RespondWithError(w http.ResponseWriter, statusCode int, message string) {
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
 
-func ProcessSingleRequest(req PayloadRequest, headers map[string]string) (ResponseWithStopID, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 69*time.Second)
-
-	defer cancel()
-
-	payloadMap := map[string]interface{}{
-		"consigneeZip":     req.FreightDetails.ConsigneeZip,
-		"shipmentMode":     req.FreightDetails.ShipmentMode,
-		"shipperZip":       req.FreightDetails.ShipperZip,
-		"miles":            req.FreightDetails.Miles,
-		"shipperCountry":   req.FreightDetails.ShipperCountry,
-		"consigneeCountry": req.FreightDetails.ConsigneeCountry,
-		"equipmentType":    req.FreightDetails.EquipmentType,
-		"accessorials":     req.FreightDetails.Accessorials,
-		"items":            req.FreightDetails.Items,
+// ProcessSingleRequest rates req with every provider at once and merges
+// their quotes. A provider that fails is reported without failing the
+// others.
+func (p *RequestProcessor) ProcessSingleRequest(ctx context.Context, req PayloadRequest) (ResponseWithStopID, error) {
+	quoteKey := QuoteKey(req.FreightDetails)
+	results := make([]ResponseWithStopID, len(p.Providers))
+	var wg sync.WaitGroup
+	for i, provider := range p.Providers {
+		wg.Add(1)
+		go func(i int, provider RateProvider) {
+			defer wg.Done()
+			results[i] = p.rateWithProvider(ctx, provider, req, quoteKey)
+		}(i, provider)
 	}
+	wg.Wait()
 
+	return mergeProviderResults(req.StopId, p.Providers, results), nil
+}
 
-	response, err := PostRequestWithContext(ctx, SharedClient, os.Getenv("REVCON_API_URL"), headers, payloadMap, req.StopId)
+func (p *RequestProcessor) rateWithProvider(ctx context.Context, provider RateProvider, req PayloadRequest, quoteKey string) ResponseWithStopID {
+	name := provider.Name()
+	cacheKey := name + ":" + quoteKey
+	cacheStatus := ""
+	if Quotes.Enabled() {
+		cacheStatus = CacheMiss
+		if p.Cache != CacheDefault {
+			cacheStatus = CacheBypass
+		}
+		if p.Cache == CacheDefault {
+			if items, ok := Quotes.Get(ctx, cacheKey); ok {
+				log.Info("[StopID: %d] Quote cache hit for %s", req.StopId, name)
+				return ResponseWithStopID{StopID: req.StopId, Response: items, Cache: CacheHit}
+			}
+		}
+	}
 
-	if err != nil {
-		return ResponseWithStopID{
-			StopID: req.StopId,
-			Error:  fmt.Sprintf("Error Posting with Context: %s", err.Error()),
-		}, nil
+	// Only the same tenant's calls are shared, so the upstream slot is always
+	// taken under the tenant the call is made for.
+	flightKey := p.Tenant + "|" + cacheKey
+	result, coalesced := Inflight.Do(ctx, flightKey, func(ctx context.Context) upstreamResult {
+		ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+		defer cancel()
+
+		var result upstreamResult
+		result.attempts, result.err = p.Retry.Do(ctx, func(ctx context.Context) error {
+			release, wait, err := Limiter.Acquire(ctx, p.Tenant)
+			result.queueWait += wait
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			var hedged bool
+			reserve := func() (func(), bool) { return Limiter.TryAcquire(p.Tenant) }
+			result.quotes, hedged, err = Hedging.Do(ctx, reserve, func(ctx context.Context) ([]APIResponseItem, error) {
+				return provider.Rate(ctx, req)
+			})
+			result.hedged = result.hedged || hedged
+			return err
+		})
+		return result
+	})
+	if coalesced {
+		log.Info("[StopID: %d] Shared an in-flight identical %s rating request", req.StopId, name)
+	}
+
+	stop := ResponseWithStopID{
+		StopID:      req.StopId,
+		Attempts:    result.attempts,
+		QueueWaitMs: result.queueWait.Milliseconds(),
+		Cache:       cacheStatus,
+		Coalesced:   coalesced,
+		Hedged:      result.hedged,
+	}
+	err := result.err
+
+	if errors.Is(err, ErrCircuitOpen) {
+		log.Warning("[StopID: %d] %s circuit breaker is open, failing fast", req.StopId, name)
+		stop.Error = fmt.Sprintf("%s is currently unavailable, try again later", name)
+		stop.ErrorCode = ErrorCodeUpstreamUnavailable
+		return stop
+	}
+
+	if errors.Is(err, ErrOverloaded) {
+		log.Warning("[StopID: %d] Upstream wait queue is full, shedding stop", req.StopId)
+		stop.Error = "Too many rating requests in progress, try again later"
+		stop.ErrorCode = ErrorCodeOverloaded
+		return stop
 	}
 
-	var apiResponse []APIResponseItem
-	err = json.Unmarshal([]byte(response), &apiResponse)
 	if err != nil {
-		return ResponseWithStopID{
-			StopID:   req.StopId,
-			Response: []APIResponseItem{},
-			Error:    err.Error(),
-		}, nil
+		log.Error("[StopID: %d] Giving up on %s after %d attempt(s): %v", req.StopId, name, result.attempts, err)
+		stop.Error = fmt.Sprintf("Error Posting with Context: %s", err.Error())
+		return stop
+	}
+
+	if result.quotes == nil {
+		result.quotes = []APIResponseItem{}
+	}
+	if Quotes.Enabled() && p.Cache != CacheNoStore {
+		Quotes.Set(ctx, cacheKey, result.quotes)
 	}
 
-	return ResponseWithStopID{StopID: req.StopId, Response: apiResponse}, nil
+	stop.Response = result.quotes
+	return stop
 }
 
-func (p *RequestProcessor) ProcessRequestsInParallel(requests []PayloadRequest) ([]ResponseWithStopID, error) {
+type indexedRequest struct {
+	index   int
+	request PayloadRequest
+}
+
+type indexedResponse struct {
+	index    int
+	response ResponseWithStopID
+}
+
+// ProcessRequestsInParallel returns exactly one response per request, in the
+// same order as requests. Once ctx is done no new upstream calls are started
+// and unfinished stops are reported as timed out or cancelled.
+func (p *RequestProcessor) ProcessRequestsInParallel(ctx context.Context, requests []PayloadRequest) ([]ResponseWithStopID, error) {
 
-	responseChan := make(chan ResponseWithStopID, len(requests))
+	responseChan := make(chan indexedResponse, len(requests))
 	var wg sync.WaitGroup
 
-	requestQueue := make(chan PayloadRequest, len(requests))
-	for _, request := range requests {
-		requestQueue <- request
+	requestQueue := make(chan indexedRequest, len(requests))
+	for i, request := range requests {
+		requestQueue <- indexedRequest{index: i, request: request}
 	}
 	close(requestQueue)
 
@@ -265,29 +388,64 @@ func (p *RequestProcessor) ProcessRequestsInParallel(requests []PayloadRequest)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for req := range requestQueue {
-				response, err := ProcessSingleRequest(req, p.Headers)
+			for item := range requestQueue {
+				req := item.request
+				if len(req.Violations) > 0 {
+					responseChan <- indexedResponse{index: item.index, response: invalidResponse(req)}
+					continue
+				}
+				if ctx.Err() != nil {
+					responseChan <- indexedResponse{index: item.index, response: abandonedResponse(ctx, req)}
+					continue
+				}
+				response, err := p.ProcessSingleRequest(ctx, req)
 				if err != nil {
 					log.Error("%v", err.Error())
-					responseChan <- ResponseWithStopID{
+					response = ResponseWithStopID{
 						StopID:   req.StopId,
 						Response: nil,
 						Error:    err.Error(),
 					}
-					continue
 				}
-				responseChan <- response
+				if response.Error != "" && ctx.Err() != nil {
+					markAbandoned(ctx, &response)
+				}
+				p.Carriers.Apply(&response, p.Options.Debug)
+				p.Markup.Apply(&response, req.FreightDetails)
+				Calendar.Annotate(&response, req.ShipDate)
+				p.Options.Apply(&response)
+				response.OriginalStopID = req.OriginalStopId
+				response.Classification = req.Classification
+				responseChan <- indexedResponse{index: item.index, response: response}
 			}
 		}()
 	}
 
-	wg.Wait()
-	close(responseChan)
+	go func() {
+		wg.Wait()
+		close(responseChan)
+	}()
 
-	var responses []ResponseWithStopID
+	responses := make([]ResponseWithStopID, len(requests))
+	filled := make([]bool, len(requests))
 
-	for response := range responseChan {
-		responses = append(responses, response)
+	for item := range responseChan {
+		responses[item.index] = item.response
+		filled[item.index] = true
+		if p.OnResult != nil {
+			p.OnResult(item.index, item.response)
+		}
+	}
+
+	for i, req := range requests {
+		if !filled[i] {
+			log.Error("[StopID: %d] No result produced", req.StopId)
+			responses[i] = ResponseWithStopID{
+				StopID:         req.StopId,
+				OriginalStopID: req.OriginalStopId,
+				Error:          "no result produced for this stop",
+			}
+		}
 	}
 
 	return responses, nil
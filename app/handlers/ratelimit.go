@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"dunlap/app/log"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// TokenBucket paces outgoing calls to a configured rate with room for short
+// bursts. When upstream answers 429 the rate is halved, at most once per
+// RecoverEvery so a burst of 429s counts once, then recovers by a tenth of
+// the configured rate for every quiet RecoverEvery interval.
+type TokenBucket struct {
+	mu           sync.Mutex
+	configured   float64
+	rate         float64
+	burst        float64
+	tokens       float64
+	last         time.Time
+	throttledAt  time.Time
+	lastThrottle time.Time
+	minRate      float64
+	recoverEvery time.Duration
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		configured:   rate,
+		rate:         rate,
+		burst:        float64(burst),
+		tokens:       float64(burst),
+		last:         time.Now(),
+		minRate:      rate / 10,
+		recoverEvery: 10 * time.Second,
+	}
+}
+
+// Wait blocks until a call may be sent. A bucket with no rate never waits.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	if b == nil || b.configured <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	b.refillLocked(time.Now())
+	b.tokens--
+	if b.tokens >= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Throttle slows the bucket down after upstream rejected a call with 429.
+func (b *TokenBucket) Throttle() {
+	if b == nil || b.configured <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if !b.lastThrottle.IsZero() && now.Sub(b.lastThrottle) < b.recoverEvery {
+		return
+	}
+	b.lastThrottle = now
+	b.refillLocked(now)
+	b.rate /= 2
+	if b.rate < b.minRate {
+		b.rate = b.minRate
+	}
+	b.throttledAt = now
+	log.Warning("Upstream returned 429, pacing down to %.2f requests/second", b.rate)
+}
+
+func (b *TokenBucket) refillLocked(now time.Time) {
+	if b.rate < b.configured && !b.throttledAt.IsZero() {
+		if steps := int(now.Sub(b.throttledAt) / b.recoverEvery); steps > 0 {
+			b.rate += float64(steps) * b.configured / 10
+			if b.rate > b.configured {
+				b.rate = b.configured
+			}
+			b.throttledAt = b.throttledAt.Add(time.Duration(steps) * b.recoverEvery)
+		}
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+type BucketStats struct {
+	ConfiguredRate float64 `json:"configuredRate"`
+	CurrentRate    float64 `json:"currentRate"`
+	Burst          float64 `json:"burst"`
+	Tokens         float64 `json:"tokens"`
+}
+
+func (b *TokenBucket) Stats() BucketStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	return BucketStats{ConfiguredRate: b.configured, CurrentRate: b.rate, Burst: b.burst, Tokens: b.tokens}
+}
+
+// RateLimits holds one token bucket per upstream endpoint. Endpoints without
+// an override share the default bucket.
+type RateLimits struct {
+	fallback  *TokenBucket
+	endpoints map[string]*TokenBucket
+}
+
+// Outbound paces every call made through PostRequestWithContext.
+var Outbound = &RateLimits{endpoints: map[string]*TokenBucket{}}
+
+type rateOverride struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// LoadRateLimits reads UPSTREAM_RPS and UPSTREAM_BURST for the default
+// bucket and UPSTREAM_RPS_OVERRIDES as a JSON object of per-URL limits, e.g.
+// {"https://api.example.com/rate": {"rate": 5, "burst": 2}}. Calls are not
+// paced unless UPSTREAM_RPS or an override is set.
+func LoadRateLimits() *RateLimits {
+	limits := &RateLimits{
+		fallback:  NewTokenBucket(envFloat("UPSTREAM_RPS", 0), envInt("UPSTREAM_BURST", 10)),
+		endpoints: map[string]*TokenBucket{},
+	}
+
+	if raw := os.Getenv("UPSTREAM_RPS_OVERRIDES"); raw != "" {
+		var overrides map[string]rateOverride
+		if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+			log.Warning("Invalid UPSTREAM_RPS_OVERRIDES, ignoring: %v", err)
+		}
+		for url, override := range overrides {
+			limits.endpoints[url] = NewTokenBucket(override.Rate, override.Burst)
+		}
+	}
+	return limits
+}
+
+func (l *RateLimits) For(url string) *TokenBucket {
+	if bucket, ok := l.endpoints[url]; ok {
+		return bucket
+	}
+	return l.fallback
+}
+
+func (l *RateLimits) Stats() map[string]BucketStats {
+	stats := make(map[string]BucketStats, len(l.endpoints)+1)
+	if l.fallback != nil {
+		stats["default"] = l.fallback.Stats()
+	}
+	for url, bucket := range l.endpoints {
+		stats[url] = bucket.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how many times an upstream rating call is attempted
+// and how long to wait between attempts.
+type RetryPolicy struct {
+	MaxAttempts    int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	Jitter         float64
+	AttemptTimeout time.Duration
+}
+
+func LoadRetryPolicy() RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:    envInt("RETRY_MAX_ATTEMPTS", 3),
+		BaseDelay:      envDuration("RETRY_BASE_DELAY", 250*time.Millisecond),
+		MaxDelay:       envDuration("RETRY_MAX_DELAY", 5*time.Second),
+		Jitter:         envFloat("RETRY_JITTER", 0.5),
+		AttemptTimeout: envDuration("RETRY_ATTEMPT_TIMEOUT", 0),
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if policy.Jitter < 0 {
+		policy.Jitter = 0
+	}
+	if policy.Jitter > 1 {
+		policy.Jitter = 1
+	}
+	return policy
+}
+
+// Do calls attempt until it succeeds, returns a non-retryable error, the
+// attempts run out, or the next wait would overrun ctx's deadline. It returns
+// the number of attempts made.
+func (p RetryPolicy) Do(ctx context.Context, attempt func(ctx context.Context) error) (int, error) {
+	var err error
+	for n := 1; ; n++ {
+		err = p.try(ctx, attempt)
+		if err == nil {
+			return n, nil
+		}
+
+		retryable, retryAfter := classifyUpstreamError(ctx, err)
+		if !retryable || n >= p.MaxAttempts {
+			return n, err
+		}
+
+		wait := p.backoff(n)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return n, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return n, err
+		}
+	}
+}
+
+func (p RetryPolicy) try(ctx context.Context, attempt func(ctx context.Context) error) error {
+	if p.AttemptTimeout <= 0 {
+		return attempt(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, p.AttemptTimeout)
+	defer cancel()
+	return attempt(attemptCtx)
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 && delay > 0 {
+		spread := time.Duration(float64(delay) * p.Jitter)
+		delay = delay - spread + time.Duration(rand.Int63n(int64(spread)+1))
+	}
+	return delay
+}
+
+// classifyUpstreamError reports whether err is worth another attempt and, for
+// 429 and 5xx responses, how long upstream asked us to wait.
+func classifyUpstreamError(ctx context.Context, err error) (bool, time.Duration) {
+	if ctx.Err() != nil {
+		return false, 0
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500 {
+			return true, parseRetryAfter(statusErr.Header.Get("Retry-After"))
+		}
+		return false, 0
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true, 0
+	}
+
+	// Transport failures (timeouts, resets, refused connections) all surface
+	// from client.Do wrapped in *url.Error.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true, 0
+	}
+
+	return false, 0
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+const RevConProviderName = "revcon"
+
+// RevConProvider rates stops through RevCon's API using the shared OAuth
+// token. Its calls are paced by Outbound and guarded by Breaker.
+type RevConProvider struct {
+	URL     string
+	Headers map[string]string
+}
+
+func NewRevConProvider() (RateProvider, error) {
+	url := os.Getenv("REVCON_API_URL")
+	if url == "" {
+		return nil, errors.New("REVCON_API_URL is not set")
+	}
+	return &RevConProvider{
+		URL: url,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}, nil
+}
+
+func (r *RevConProvider) Name() string {
+	return RevConProviderName
+}
+
+func (r *RevConProvider) Rate(ctx context.Context, req PayloadRequest) ([]APIResponseItem, error) {
+	payloadMap := map[string]interface{}{
+		"consigneeZip":     req.FreightDetails.ConsigneeZip,
+		"shipmentMode":     req.FreightDetails.ShipmentMode,
+		"shipperZip":       req.FreightDetails.ShipperZip,
+		"miles":            req.FreightDetails.Miles,
+		"shipperCountry":   req.FreightDetails.ShipperCountry,
+		"consigneeCountry": req.FreightDetails.ConsigneeCountry,
+		"equipmentType":    req.FreightDetails.EquipmentType,
+		"accessorials":     req.FreightDetails.Accessorials,
+		"items":            req.FreightDetails.Items,
+	}
+
+	response, err := postWithAuth(ctx, SharedClient, r.URL, r.Headers, payloadMap, req.StopId)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotes []APIResponseItem
+	if err := json.Unmarshal([]byte(response), &quotes); err != nil {
+		return nil, err
+	}
+	return quotes, nil
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"dunlap/app/log"
+	"encoding/json"
+	"fmt"
+)
+
+// checkStopIDs makes sure every request carries a stopId and that no two
+// requests share one. With disambiguate set, duplicates are given fresh IDs
+// above the highest one in the batch and keep their original in
+// OriginalStopId instead of failing the batch.
+func checkStopIDs(body []byte, requests []PayloadRequest, disambiguate bool) error {
+	var ids []struct {
+		StopId *int `json:"stopId"`
+	}
+	if err := json.Unmarshal(body, &ids); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if id.StopId == nil {
+			return fmt.Errorf("request at index %d has no stopId", i)
+		}
+	}
+
+	highest := 0
+	for _, req := range requests {
+		if req.StopId > highest {
+			highest = req.StopId
+		}
+	}
+
+	seen := make(map[int]int, len(requests))
+	for i := range requests {
+		stopID := requests[i].StopId
+		first, duplicate := seen[stopID]
+		if !duplicate {
+			seen[stopID] = i
+			continue
+		}
+		if !disambiguate {
+			return fmt.Errorf("duplicate stopId %d at indexes %d and %d", stopID, first, i)
+		}
+		highest++
+		original := stopID
+		requests[i].StopId = highest
+		requests[i].OriginalStopId = &original
+		seen[highest] = i
+		log.Info("Renumbered duplicate stopId %d at index %d to %d", original, i, highest)
+	}
+	return nil
+}
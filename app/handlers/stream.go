@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"dunlap/app/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeSSE    = "text/event-stream"
+)
+
+// NegotiateStream returns the streaming content type the client asked for in
+// its Accept header, or "" when a plain JSON array should be sent.
+func NegotiateStream(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case ContentTypeNDJSON, ContentTypeSSE:
+			return mediaType
+		case "application/json":
+			return ""
+		}
+	}
+	return ""
+}
+
+type BatchSummary struct {
+	Total      int   `json:"total"`
+	Succeeded  int   `json:"succeeded"`
+	Failed     int   `json:"failed"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// ResultStream writes each stop's response to the client as soon as it is
+// ready, as newline-delimited JSON or server-sent events.
+type ResultStream struct {
+	w           http.ResponseWriter
+	flusher     http.Flusher
+	contentType string
+	started     time.Time
+	summary     BatchSummary
+}
+
+func NewResultStream(w http.ResponseWriter, contentType string) (*ResultStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming is not supported by this connection")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &ResultStream{w: w, flusher: flusher, contentType: contentType, started: time.Now()}, nil
+}
+
+func (s *ResultStream) WriteResult(response ResponseWithStopID) {
+	s.summary.Total++
+	if response.Error != "" {
+		s.summary.Failed++
+	} else {
+		s.summary.Succeeded++
+	}
+	s.write("result", response)
+}
+
+// Close sends the final summary record.
+func (s *ResultStream) Close() {
+	s.summary.DurationMs = time.Since(s.started).Milliseconds()
+	s.write("summary", map[string]BatchSummary{"summary": s.summary})
+}
+
+func (s *ResultStream) write(event string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Error("Error encoding streamed %s: %v", event, err)
+		return
+	}
+
+	if s.contentType == ContentTypeSSE {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	} else {
+		_, err = fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if err != nil {
+		log.Error("Error streaming %s: %v", event, err)
+		return
+	}
+	s.flusher.Flush()
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+var digitRuns = regexp.MustCompile(`\d+`)
+
+// transitDays pulls the number of business days out of RevCon's free-form
+// transit time, e.g. "3", "3 days" or "2-3 Days" (the upper bound is used).
+func transitDays(transitTime string) (int, bool) {
+	numbers := digitRuns.FindAllString(transitTime, -1)
+	if len(numbers) == 0 {
+		return 0, false
+	}
+	days, err := strconv.Atoi(numbers[len(numbers)-1])
+	if err != nil {
+		return 0, false
+	}
+	return days, true
+}
+
+// BusinessCalendar knows which dates carriers move freight on.
+type BusinessCalendar struct {
+	workdays map[time.Weekday]bool
+	holidays map[string]bool
+}
+
+// Calendar is used to turn transit days into delivery dates.
+var Calendar = NewBusinessCalendar(nil, nil)
+
+// NewBusinessCalendar builds a calendar from its working weekdays (Monday to
+// Friday when empty) and holiday dates in YYYY-MM-DD form.
+func NewBusinessCalendar(workdays []time.Weekday, holidays []string) *BusinessCalendar {
+	if len(workdays) == 0 {
+		workdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	}
+	calendar := &BusinessCalendar{workdays: map[time.Weekday]bool{}, holidays: map[string]bool{}}
+	for _, day := range workdays {
+		calendar.workdays[day] = true
+	}
+	for _, holiday := range holidays {
+		calendar.holidays[holiday] = true
+	}
+	return calendar
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"SUN": time.Sunday, "MON": time.Monday, "TUE": time.Tuesday, "WED": time.Wednesday,
+	"THU": time.Thursday, "FRI": time.Friday, "SAT": time.Saturday,
+}
+
+// LoadBusinessCalendar reads BUSINESS_DAYS (e.g. "Mon,Tue,Wed,Thu,Fri") and
+// HOLIDAYS (e.g. "2026-11-26,2026-12-25").
+func LoadBusinessCalendar() *BusinessCalendar {
+	var workdays []time.Weekday
+	for _, name := range splitList(os.Getenv("BUSINESS_DAYS")) {
+		if len(name) >= 3 {
+			if day, ok := weekdayNames[name[:3]]; ok {
+				workdays = append(workdays, day)
+			}
+		}
+	}
+
+	var holidays []string
+	for _, value := range strings.Split(os.Getenv("HOLIDAYS"), ",") {
+		if date, err := time.Parse(dateLayout, strings.TrimSpace(value)); err == nil {
+			holidays = append(holidays, date.Format(dateLayout))
+		}
+	}
+	return NewBusinessCalendar(workdays, holidays)
+}
+
+func (c *BusinessCalendar) IsBusinessDay(date time.Time) bool {
+	return c.workdays[date.Weekday()] && !c.holidays[date.Format(dateLayout)]
+}
+
+// AddBusinessDays returns the date days business days after start.
+func (c *BusinessCalendar) AddBusinessDays(start time.Time, days int) time.Time {
+	date := start
+	for days > 0 {
+		date = date.AddDate(0, 0, 1)
+		if c.IsBusinessDay(date) {
+			days--
+		}
+	}
+	return date
+}
+
+// Annotate fills in TransitDays and EstimatedDelivery on every quote in
+// response. shipDate is YYYY-MM-DD; when empty the freight ships today.
+func (c *BusinessCalendar) Annotate(response *ResponseWithStopID, shipDate string) {
+	start := time.Now()
+	if shipDate != "" {
+		parsed, err := time.Parse(dateLayout, shipDate)
+		if err != nil {
+			return
+		}
+		start = parsed
+	}
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+
+	for i := range response.Response {
+		quote := &response.Response[i]
+		days, ok := transitDays(quote.TransitTime)
+		if !ok {
+			continue
+		}
+		quote.TransitDays = &days
+		quote.EstimatedDelivery = c.AddBusinessDays(start, days).Format(dateLayout)
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The units RevCon expects. Everything else is converted to these before the
+// upstream payload is built.
+const (
+	UnitPound            = "lb"
+	UnitInch             = "in"
+	UnitPoundsPerCubicFt = "lb-ft3"
+)
+
+// Conversion factors to RevCon's units, keyed by every accepted spelling.
+// Blank and "0" mean the caller sent RevCon's units already.
+var (
+	weightUnits = map[string]float64{
+		"": 1, "0": 1, "lb": 1, "lbs": 1, "pound": 1, "pounds": 1,
+		"kg": 2.20462262, "kgs": 2.20462262, "kilogram": 2.20462262, "kilograms": 2.20462262,
+	}
+	dimensionUnits = map[string]float64{
+		"": 1, "0": 1, "in": 1, "inch": 1, "inches": 1,
+		"cm": 1 / 2.54, "centimeter": 1 / 2.54, "centimeters": 1 / 2.54,
+		"ft": 12, "foot": 12, "feet": 12,
+		"m": 100 / 2.54, "meter": 100 / 2.54, "meters": 100 / 2.54, "metre": 100 / 2.54, "metres": 100 / 2.54,
+	}
+	densityUnits = map[string]float64{
+		"": 1, "0": 1, "lb-ft3": 1, "lb/ft3": 1, "pcf": 1,
+		"kg-m3": 0.0624279606, "kg/m3": 0.0624279606,
+	}
+)
+
+func unitKey(unit string) string {
+	return strings.ToLower(strings.TrimSpace(unit))
+}
+
+func knownUnit(units map[string]float64, unit string) bool {
+	_, ok := units[unitKey(unit)]
+	return ok
+}
+
+// NormalizeUnits converts every valid request's item weights, dimensions and
+// density to RevCon's units. Requests that failed validation are left as
+// sent.
+func NormalizeUnits(requests []PayloadRequest) {
+	for i := range requests {
+		if len(requests[i].Violations) > 0 {
+			continue
+		}
+		items := requests[i].FreightDetails.Items
+		for j := range items {
+			normalizeItemUnits(&items[j])
+		}
+	}
+}
+
+// normalizeItemUnits only rewrites a unit field whose unit it converted from,
+// so items already in RevCon's units reach it exactly as sent.
+func normalizeItemUnits(item *FreightItem) {
+	if factor := weightUnits[unitKey(item.UnitsWeight)]; factor != 1 {
+		item.Weight = int(math.Round(float64(item.Weight) * factor))
+		item.UnitsWeight = UnitPound
+	}
+
+	// Dimensions are rounded up so converted freight never measures smaller
+	// than it is.
+	if factor := dimensionUnits[unitKey(item.UnitsDimension)]; factor != 1 {
+		item.Length = int(math.Ceil(float64(item.Length)*factor - 1e-9))
+		item.Width = int(math.Ceil(float64(item.Width)*factor - 1e-9))
+		item.Height = int(math.Ceil(float64(item.Height)*factor - 1e-9))
+		item.UnitsDimension = UnitInch
+	}
+
+	// A blank or zero density means "not given" and is left for
+	// ClassifyRequests to compute, which it does in RevCon's units.
+	if factor := densityUnits[unitKey(item.UnitsDensity)]; factor != 1 {
+		if density, err := strconv.ParseFloat(strings.TrimSpace(item.Density), 64); err == nil && density != 0 {
+			item.Density = strconv.FormatFloat(density*factor, 'f', 2, 64)
+		}
+		item.UnitsDensity = UnitPoundsPerCubicFt
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const ErrorCodeInvalidRequest = "INVALID_REQUEST"
+
+// Violation is one problem found in a rating request. Path is a JSON pointer
+// into the submitted array, e.g. /2/freightDetails/items/0/weight.
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+var postalFormats = map[string]*regexp.Regexp{
+	"USA": regexp.MustCompile(`^\d{5}(-?\d{4})?$`),
+	"CAN": regexp.MustCompile(`^[ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z]\d[ABCEGHJ-NPRSTV-Z]\d$`),
+	"MEX": regexp.MustCompile(`^\d{5}$`),
+}
+
+var countryAliases = map[string]string{
+	"US":  "USA",
+	"USA": "USA",
+	"CA":  "CAN",
+	"CAN": "CAN",
+	"MX":  "MEX",
+	"MEX": "MEX",
+}
+
+var freightClasses = map[string]bool{
+	"50": true, "55": true, "60": true, "65": true, "70": true, "77.5": true,
+	"85": true, "92.5": true, "100": true, "110": true, "125": true, "150": true,
+	"175": true, "200": true, "250": true, "300": true, "400": true, "500": true,
+}
+
+var accessorialFormat = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+// ValidateRequests checks every request's freight details, records the
+// problems on each request's Violations and returns them all.
+func ValidateRequests(requests []PayloadRequest) []Violation {
+	allowedAccessorials := map[string]bool{}
+	for _, code := range splitList(os.Getenv("ACCESSORIAL_CODES")) {
+		allowedAccessorials[code] = true
+	}
+
+	var all []Violation
+	for i := range requests {
+		requests[i].Violations = validateFreightDetails(fmt.Sprintf("/%d/freightDetails", i), requests[i].FreightDetails, allowedAccessorials)
+		if shipDate := requests[i].ShipDate; shipDate != "" {
+			if _, err := time.Parse(dateLayout, shipDate); err != nil {
+				requests[i].Violations = append(requests[i].Violations, Violation{
+					Path:    fmt.Sprintf("/%d/shipDate", i),
+					Message: fmt.Sprintf("%q is not a date in YYYY-MM-DD form", shipDate),
+				})
+			}
+		}
+		all = append(all, requests[i].Violations...)
+	}
+	return all
+}
+
+func validateFreightDetails(base string, details FreightDetails, allowedAccessorials map[string]bool) []Violation {
+	var violations []Violation
+	add := func(field, format string, args ...interface{}) {
+		violations = append(violations, Violation{Path: base + "/" + field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(details.ShipmentMode) == "" {
+		add("shipmentMode", "is required")
+	}
+
+	checkPostal := func(zipField, countryField, zip, country string) {
+		canonical, known := countryAliases[normalizeCode(country)]
+		switch {
+		case strings.TrimSpace(country) == "":
+			add(countryField, "is required")
+		case !known:
+			add(countryField, "unsupported country %q", country)
+		}
+		if strings.TrimSpace(zip) == "" {
+			add(zipField, "is required")
+			return
+		}
+		if known && !postalFormats[canonical].MatchString(normalizePostalCode(zip)) {
+			add(zipField, "%q is not a valid %s postal code", zip, canonical)
+		}
+	}
+	checkPostal("shipperZip", "shipperCountry", details.ShipperZip, details.ShipperCountry)
+	checkPostal("consigneeZip", "consigneeCountry", details.ConsigneeZip, details.ConsigneeCountry)
+
+	for i, code := range details.Accessorials {
+		code = normalizeCode(code)
+		field := fmt.Sprintf("accessorials/%d", i)
+		switch {
+		case !accessorialFormat.MatchString(code):
+			add(field, "%q is not a valid accessorial code", details.Accessorials[i])
+		case len(allowedAccessorials) > 0 && !allowedAccessorials[code]:
+			add(field, "unknown accessorial code %q", details.Accessorials[i])
+		}
+	}
+
+	if len(details.Items) == 0 {
+		add("items", "at least one item is required")
+	}
+	for i, item := range details.Items {
+		field := func(name string) string { return fmt.Sprintf("items/%d/%s", i, name) }
+		if class := strings.TrimSpace(item.Class); class == "" {
+			if _, ok := itemDensity(item); !ok {
+				add(field("class"), "is required unless length, width and height are given")
+			}
+		} else if !freightClasses[class] {
+			add(field("class"), "%q is not a known freight class", item.Class)
+		}
+		if item.Weight <= 0 {
+			add(field("weight"), "must be greater than zero")
+		}
+		if item.Pieces <= 0 {
+			add(field("pieces"), "must be greater than zero")
+		}
+		if item.Length < 0 {
+			add(field("length"), "must not be negative")
+		}
+		if item.Width < 0 {
+			add(field("width"), "must not be negative")
+		}
+		if item.Height < 0 {
+			add(field("height"), "must not be negative")
+		}
+		if !knownUnit(weightUnits, item.UnitsWeight) {
+			add(field("unitsWeight"), "unknown weight unit %q, expected lb or kg", item.UnitsWeight)
+		}
+		if !knownUnit(dimensionUnits, item.UnitsDimension) {
+			add(field("unitsDimension"), "unknown dimension unit %q, expected in, cm, ft or m", item.UnitsDimension)
+		}
+		if !knownUnit(densityUnits, item.UnitsDensity) {
+			add(field("unitsDensity"), "unknown density unit %q, expected lb-ft3 or kg-m3", item.UnitsDensity)
+		}
+	}
+
+	return violations
+}
+
+// RespondWithViolations rejects a batch whose requests failed validation.
+func RespondWithViolations(w http.ResponseWriter, violations []Violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "Request validation failed",
+		"violations": violations,
+	})
+}
+
+// invalidResponse reports a stop that was skipped because it failed
+// validation.
+func invalidResponse(req PayloadRequest) ResponseWithStopID {
+	return ResponseWithStopID{
+		StopID:         req.StopId,
+		OriginalStopID: req.OriginalStopId,
+		Error:          "Request validation failed",
+		ErrorCode:      ErrorCodeInvalidRequest,
+		Violations:     req.Violations,
+	}
+}
@@ -9,7 +9,8 @@ import (
 func SetupCORS() *cors.Cors {
 	return cors.New(cors.Options{
 		AllowedOrigins: []string{os.Getenv("CORS_ALLOWED_ORIGINS")},
-		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		AllowedMethods: []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "X-Batch-Deadline", "Cache-Control"},
+		ExposedHeaders: []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 	})
 }
@@ -1,13 +1,35 @@
 package middleware
 
 import (
+	"context"
 	"dunlap/app/log"
 	"dunlap/app/mongo"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
+type contextKey string
+
+const apiKeyKey contextKey = "apiKey"
+
+// KeyFromContext returns the API key document that authenticated the
+// request, or nil if there is none.
+func KeyFromContext(ctx context.Context) *mongo.APIKey {
+	key, _ := ctx.Value(apiKeyKey).(*mongo.APIKey)
+	return key
+}
+
+// TenantFromContext returns the tenant of the API key that authenticated the
+// request, or "" if there is none.
+func TenantFromContext(ctx context.Context) string {
+	if key := KeyFromContext(ctx); key != nil {
+		return key.TenantID()
+	}
+	return ""
+}
+
 func ApiKeyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -24,12 +46,48 @@ func ApiKeyMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		if !mongo.ValidateMongoKey(os.Getenv("MongoURI"), "honda", "apikeys", token) {
+		key, err := Keys.Lookup(r.Context(), token)
+		if err != nil {
+			log.Error("Error looking up API Key: %v", err)
+			http.Error(w, "Service Unavailable - Unable to validate API Key", http.StatusServiceUnavailable)
+			return
+		}
+		if key == nil {
 			log.Error("Invalid API Key")
 			http.Error(w, "Unauthorized - Invalid API Key", http.StatusUnauthorized)
 			return
 		}
+		if !key.Active(time.Now()) {
+			log.Error("API Key %s is disabled or expired", key.ID.Hex())
+			http.Error(w, "Unauthorized - API Key is disabled or expired", http.StatusUnauthorized)
+			return
+		}
+		recordKeyUse(key)
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), apiKeyKey, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// lastUsedInterval bounds how often each key's lastUsedAt is written, so busy
+// keys do not cost a Mongo write per request.
+const lastUsedInterval = time.Minute
+
+var lastUsedWrites sync.Map
+
+func recordKeyUse(key *mongo.APIKey) {
+	now := time.Now()
+	id := key.ID.Hex()
+	if previous, ok := lastUsedWrites.Load(id); ok && now.Sub(previous.(time.Time)) < lastUsedInterval {
+		return
+	}
+	lastUsedWrites.Store(id, now)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := mongo.TouchAPIKey(ctx, apiKeyDatabase, apiKeyCollection, key.ID, now); err != nil {
+			log.Error("Error recording use of API key %s: %v", id, err)
+		}
+	}()
+}
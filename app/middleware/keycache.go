@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"dunlap/app/log"
+	"dunlap/app/mongo"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	apiKeyDatabase   = "honda"
+	apiKeyCollection = "apikeys"
+)
+
+// KeyCache remembers API key lookups so most requests never reach Mongo.
+// Valid keys are kept for positiveTTL and unknown ones for negativeTTL.
+// Invalidate drops a key on this replica at once; other replicas stop
+// accepting a revoked key when their positive TTL runs out. Entries are
+// keyed by a digest of the token so plaintext keys are not held in memory.
+type KeyCache struct {
+	mu          sync.Mutex
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	size        int
+	entries     map[[sha256.Size]byte]keyCacheEntry
+}
+
+type keyCacheEntry struct {
+	key     *mongo.APIKey
+	expires time.Time
+}
+
+// Keys is the cache used by ApiKeyMiddleware.
+var Keys = NewKeyCache(time.Minute, 10*time.Second, 10000)
+
+func NewKeyCache(positiveTTL, negativeTTL time.Duration, size int) *KeyCache {
+	return &KeyCache{
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		size:        size,
+		entries:     map[[sha256.Size]byte]keyCacheEntry{},
+	}
+}
+
+// LoadKeyCache reads API_KEY_CACHE_TTL, API_KEY_NEGATIVE_TTL and
+// API_KEY_CACHE_SIZE. A TTL of 0 turns that side of the cache off.
+func LoadKeyCache() *KeyCache {
+	positiveTTL := time.Minute
+	negativeTTL := 10 * time.Second
+	size := 10000
+
+	for name, target := range map[string]*time.Duration{"API_KEY_CACHE_TTL": &positiveTTL, "API_KEY_NEGATIVE_TTL": &negativeTTL} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				log.Warning("Invalid duration for %s: %q, using %v", name, value, *target)
+				continue
+			}
+			*target = d
+		}
+	}
+	if value := os.Getenv("API_KEY_CACHE_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Warning("Invalid integer for API_KEY_CACHE_SIZE: %q, using %d", value, size)
+		} else {
+			size = n
+		}
+	}
+
+	return NewKeyCache(positiveTTL, negativeTTL, size)
+}
+
+// Lookup returns the key document for token, or nil if there is none. Mongo
+// errors are returned and not cached.
+func (c *KeyCache) Lookup(ctx context.Context, token string) (*mongo.APIKey, error) {
+	digest := sha256.Sum256([]byte(token))
+	if key, ok := c.get(digest); ok {
+		return key, nil
+	}
+
+	key, err := mongo.FindMongoKey(ctx, apiKeyDatabase, apiKeyCollection, token)
+	if err != nil {
+		return nil, err
+	}
+	c.put(digest, key)
+	return key, nil
+}
+
+// Invalidate forgets token so the next request using it is checked against
+// Mongo again.
+func (c *KeyCache) Invalidate(token string) {
+	digest := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, digest)
+}
+
+// InvalidateID forgets every cached lookup of the key document with the given
+// hex ID, for callers that revoke a key without knowing its token.
+func (c *KeyCache) InvalidateID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for digest, entry := range c.entries {
+		if entry.key != nil && entry.key.ID.Hex() == id {
+			delete(c.entries, digest)
+		}
+	}
+}
+
+func (c *KeyCache) get(digest [sha256.Size]byte) (*mongo.APIKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[digest]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, digest)
+		return nil, false
+	}
+	return entry.key, true
+}
+
+func (c *KeyCache) put(digest [sha256.Size]byte, key *mongo.APIKey) {
+	ttl := c.positiveTTL
+	if key == nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[digest]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[digest] = keyCacheEntry{key: key, expires: time.Now().Add(ttl)}
+}
+
+// evict makes room for one entry, preferring expired ones. Called with mu
+// held.
+func (c *KeyCache) evict() {
+	now := time.Now()
+	for digest, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, digest)
+		}
+	}
+	for digest := range c.entries {
+		if len(c.entries) < c.size {
+			return
+		}
+		delete(c.entries, digest)
+	}
+}
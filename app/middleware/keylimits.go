@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"dunlap/app/log"
+	"dunlap/app/mongo"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	usageDatabase   = "honda"
+	usageCollection = "apikey_usage"
+)
+
+// usageWindow is one fixed window of a key's usage, counted in Mongo so every
+// replica sees the same total.
+type usageWindow struct {
+	name  string
+	limit int
+	start time.Time
+	end   time.Time
+}
+
+func (u usageWindow) add(ctx context.Context, key *mongo.APIKey, n int) (int, error) {
+	id := fmt.Sprintf("%s:%s:%s", key.UsageID(), u.name, u.start.Format(time.RFC3339))
+	return mongo.IncrementCounter(ctx, usageDatabase, usageCollection, id, n, u.end)
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit, remaining int, reset time.Duration) {
+	if remaining < 0 {
+		remaining = 0
+	}
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+}
+
+// KeyRateLimitMiddleware enforces the key's RequestsPerMinute. It must run
+// after ApiKeyMiddleware. If the counter cannot be reached the request is let
+// through rather than failing every caller.
+func KeyRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := KeyFromContext(r.Context())
+		if key == nil || key.RequestsPerMinute <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now().UTC()
+		start := now.Truncate(time.Minute)
+		window := usageWindow{name: "requests", limit: key.RequestsPerMinute, start: start, end: start.Add(time.Minute)}
+
+		count, err := window.add(r.Context(), key, 1)
+		if err != nil {
+			log.Error("Error counting requests for API key %s: %v", key.ID.Hex(), err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reset := window.end.Sub(now)
+		setRateLimitHeaders(w, window.limit, window.limit-count, reset)
+		if count > window.limit {
+			log.Warning("API key %s exceeded %d requests per minute", key.ID.Hex(), window.limit)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too Many Requests - limit of %d requests per minute reached", window.limit), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StopQuota charges the stops in a rating request against the key's daily
+// and monthly stop quotas before next runs, and rejects the request whole if
+// it would go over either. The charge is refunded if next does not answer
+// with a 2xx, so batches rejected as invalid, shed or failed cost nothing.
+// Bodies that are not a JSON array are passed on uncharged for the handler
+// to reject.
+func StopQuota(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := KeyFromContext(r.Context())
+		if key == nil || (key.DailyStopQuota <= 0 && key.MonthlyStopQuota <= 0) {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad Request - Unable to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var stops []json.RawMessage
+		if err := json.Unmarshal(body, &stops); err != nil || len(stops) == 0 {
+			next(w, r)
+			return
+		}
+
+		now := time.Now().UTC()
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		windows := []usageWindow{
+			{name: "daily", limit: key.DailyStopQuota, start: day, end: day.AddDate(0, 0, 1)},
+			{name: "monthly", limit: key.MonthlyStopQuota, start: month, end: month.AddDate(0, 1, 0)},
+		}
+
+		var charged []usageWindow
+		for _, window := range windows {
+			if window.limit <= 0 {
+				continue
+			}
+			count, err := window.add(r.Context(), key, len(stops))
+			if err != nil {
+				log.Error("Error counting %s stops for API key %s: %v", window.name, key.ID.Hex(), err)
+				continue
+			}
+			charged = append(charged, window)
+			if count <= window.limit {
+				continue
+			}
+
+			// Refund the batch so a rejected request does not use up quota.
+			refundStops(key, charged, len(stops))
+
+			remaining := window.limit - (count - len(stops))
+			reset := window.end.Sub(now)
+			log.Warning("API key %s would exceed its %s stop quota of %d", key.ID.Hex(), window.name, window.limit)
+			setRateLimitHeaders(w, window.limit, remaining, reset)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too Many Requests - %d stop(s) would exceed the %s stop quota of %d", len(stops), window.name, window.limit), http.StatusTooManyRequests)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.status == 0 {
+			// net/http answers 200 for a handler that wrote nothing.
+			recorder.status = http.StatusOK
+		}
+		if recorder.status < 200 || recorder.status >= 300 {
+			refundStops(key, charged, len(stops))
+		}
+	}
+}
+
+// refundStops gives n stops back to each charged window. It does not use the
+// request's context, which may already be cancelled.
+func refundStops(key *mongo.APIKey, charged []usageWindow, n int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, window := range charged {
+		if _, err := window.add(ctx, key, -n); err != nil {
+			log.Error("Error refunding %s stops for API key %s: %v", window.name, key.ID.Hex(), err)
+		}
+	}
+}
+
+// statusRecorder remembers the status code a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed rating responses working through the recorder.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"dunlap/app/log"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Scopes an API key document can carry. ScopeAdmin grants every scope.
+const (
+	ScopeRatingSubmit = "rating:submit"
+	ScopeTokenRead    = "token:read"
+	ScopeJobsRead     = "jobs:read"
+	ScopeAdmin        = "admin"
+)
+
+// ValidScope reports whether scope is one routes can require.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeRatingSubmit, ScopeTokenRead, ScopeJobsRead, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// defaultScopes are granted to keys issued before scopes existed, so they
+// keep the access they had. API_KEY_DEFAULT_SCOPES overrides them.
+var defaultScopes = []string{ScopeRatingSubmit, ScopeTokenRead, ScopeJobsRead}
+
+func keyScopes(scopes []string) []string {
+	if len(scopes) > 0 {
+		return scopes
+	}
+	if configured := os.Getenv("API_KEY_DEFAULT_SCOPES"); configured != "" {
+		var out []string
+		for _, scope := range strings.Split(configured, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				out = append(out, scope)
+			}
+		}
+		return out
+	}
+	return defaultScopes
+}
+
+func hasScope(scopes []string, required string) bool {
+	for _, scope := range keyScopes(scopes) {
+		if scope == required || scope == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope only lets requests through to next when the API key that
+// authenticated them carries scope. It must run after ApiKeyMiddleware.
+func RequireScope(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := KeyFromContext(r.Context())
+		if key == nil {
+			http.Error(w, "Unauthorized - No API Key provided", http.StatusUnauthorized)
+			return
+		}
+		if !hasScope(key.Scopes, scope) {
+			log.Error("API key %s is missing scope %s for %s", key.ID.Hex(), scope, r.URL.Path)
+			http.Error(w, fmt.Sprintf("Forbidden - API key is missing the %q scope", scope), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
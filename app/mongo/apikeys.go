@@ -0,0 +1,217 @@
+package mongo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dunlap/app/log"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var apiKeyIndexOnce sync.Once
+
+// ErrNoAPIKeyPepper is returned instead of falling back to an unkeyed hash
+// when API_KEY_PEPPER is not set.
+var ErrNoAPIKeyPepper = errors.New("API_KEY_PEPPER is not set")
+
+// CheckAPIKeyPepper returns ErrNoAPIKeyPepper if API key secrets cannot be
+// hashed, so the service can refuse to start without it.
+func CheckAPIKeyPepper() error {
+	if os.Getenv("API_KEY_PEPPER") == "" {
+		return ErrNoAPIKeyPepper
+	}
+	return nil
+}
+
+// HashAPIKeySecret returns the keyed hash stored for an API key secret. The
+// key is API_KEY_PEPPER, which lives only in the service's environment, so a
+// copy of the database alone is not enough to check guesses against it.
+func HashAPIKeySecret(secret string) (string, error) {
+	pepper := os.Getenv("API_KEY_PEPPER")
+	if pepper == "" {
+		return "", ErrNoAPIKeyPepper
+	}
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyAPIKeySecret compares in constant time so response timing does not
+// reveal how much of a guessed secret was right.
+func verifyAPIKeySecret(storedHash, secret string) (bool, error) {
+	hash, err := HashAPIKeySecret(secret)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(storedHash), []byte(hash)) == 1, nil
+}
+
+// GenerateAPIKey returns a new token of the form prefix.secret along with
+// the prefix and hash to store for it. The token itself is never stored.
+func GenerateAPIKey() (token, prefix, hash string, err error) {
+	prefixBytes := make([]byte, 8)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", "", err
+	}
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", "", err
+	}
+
+	prefix = hex.EncodeToString(prefixBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	hash, err = HashAPIKeySecret(secret)
+	if err != nil {
+		return "", "", "", err
+	}
+	return prefix + "." + secret, prefix, hash, nil
+}
+
+// IssueAPIKey generates a token for key, stores key as a new document with
+// its prefix and hash and returns the token, which cannot be recovered
+// afterwards.
+func IssueAPIKey(ctx context.Context, databaseName, collectionName string, key *APIKey) (string, error) {
+	token, prefix, hash, err := GenerateAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	key.ID = primitive.NewObjectID()
+	key.APIKey = ""
+	key.Prefix = prefix
+	key.KeyHash = hash
+
+	collection := client.Database(databaseName).Collection(collectionName)
+	ensureAPIKeyIndexes(ctx, collection)
+	if _, err := collection.InsertOne(ctx, key); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func ensureAPIKeyIndexes(ctx context.Context, collection *mongo.Collection) {
+	apiKeyIndexOnce.Do(func() {
+		models := []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "prefix", Value: 1}},
+				Options: options.Index().SetUnique(true).SetSparse(true),
+			},
+			{
+				Keys:    bson.D{{Key: "keyHash", Value: 1}},
+				Options: options.Index().SetSparse(true),
+			},
+		}
+		if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+			log.Error("Error creating API key indexes: %v", err)
+		}
+	})
+}
+
+// MigratePlaintextAPIKeys replaces the plaintext apiKey of every document
+// that still has one with its hash and returns how many were converted.
+// FindMongoKey accepts both forms, so it can run while the service is up,
+// and it is safe to run again.
+func MigratePlaintextAPIKeys(ctx context.Context, databaseName, collectionName string) (int, error) {
+	collection := client.Database(databaseName).Collection(collectionName)
+	ensureAPIKeyIndexes(ctx, collection)
+
+	cursor, err := collection.Find(ctx, bson.M{"apiKey": bson.M{"$exists": true, "$ne": ""}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	for cursor.Next(ctx) {
+		var key APIKey
+		if err := cursor.Decode(&key); err != nil {
+			return migrated, err
+		}
+
+		hash, err := HashAPIKeySecret(key.APIKey)
+		if err != nil {
+			return migrated, err
+		}
+
+		// Matching on the plaintext too leaves the document alone if the key
+		// was changed since it was read.
+		filter := bson.M{"_id": key.ID, "apiKey": key.APIKey}
+		update := bson.M{
+			"$set":   bson.M{"keyHash": hash},
+			"$unset": bson.M{"apiKey": ""},
+		}
+		result, err := collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += int(result.ModifiedCount)
+	}
+	return migrated, cursor.Err()
+}
+
+// FindAPIKeyByID returns the key document with the given hex ID, or nil if
+// there is none.
+func FindAPIKeyByID(ctx context.Context, databaseName, collectionName, id string) (*APIKey, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, nil
+	}
+
+	var key APIKey
+	found, err := FindDocument(ctx, databaseName, collectionName, bson.M{"_id": objectID}, &key)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// UpdateAPIKey sets fields on the key document with the given hex ID and
+// reports whether it exists.
+func UpdateAPIKey(ctx context.Context, databaseName, collectionName, id string, fields map[string]interface{}) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, nil
+	}
+
+	collection := client.Database(databaseName).Collection(collectionName)
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, bson.M{"$set": fields})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// DeleteAPIKey removes the key document with the given hex ID and reports
+// whether it existed.
+func DeleteAPIKey(ctx context.Context, databaseName, collectionName, id string) (bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, nil
+	}
+
+	collection := client.Database(databaseName).Collection(collectionName)
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// TouchAPIKey records that the key was used at the given time.
+func TouchAPIKey(ctx context.Context, databaseName, collectionName string, id primitive.ObjectID, at time.Time) error {
+	collection := client.Database(databaseName).Collection(collectionName)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastUsedAt": at}})
+	return err
+}
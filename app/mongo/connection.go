@@ -8,6 +8,8 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// client is shared by every query in the package. The driver pools its
+// connections, so it is opened once at startup and closed on shutdown.
 var client *mongo.Client
 
 func ConnectMongoDB(uri string) error {
@@ -28,3 +30,13 @@ func ConnectMongoDB(uri string) error {
 	log.Info("Connected to Mongo")
 	return nil
 }
+
+// DisconnectMongoDB closes the pooled client opened by ConnectMongoDB.
+func DisconnectMongoDB(ctx context.Context) error {
+	if client == nil {
+		return nil
+	}
+	err := client.Disconnect(ctx)
+	client = nil
+	return err
+}
@@ -0,0 +1,48 @@
+package mongo
+
+import (
+	"context"
+	"dunlap/app/log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var counterIndexOnce sync.Once
+
+func ensureCounterIndex(ctx context.Context, collection *mongo.Collection) {
+	counterIndexOnce.Do(func() {
+		model := mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}
+		if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+			log.Error("Error creating counter TTL index: %v", err)
+		}
+	})
+}
+
+// IncrementCounter atomically adds by to the counter id, creating it if
+// needed, and returns the new total. Mongo removes the counter once
+// expiresAt has passed.
+func IncrementCounter(ctx context.Context, dbName, collectionName, id string, by int, expiresAt time.Time) (int, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	ensureCounterIndex(ctx, collection)
+
+	filter := bson.M{"_id": id}
+	update := bson.M{"$inc": bson.M{"count": by}, "$setOnInsert": bson.M{"expiresAt": expiresAt}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var result struct {
+		Count int `bson:"count"`
+	}
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another replica created the counter first; it exists now.
+		err = collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	}
+	return result.Count, err
+}
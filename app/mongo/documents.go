@@ -0,0 +1,84 @@
+package mongo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FindDocument decodes the first document matching filter into result and
+// reports whether one was found.
+func FindDocument(ctx context.Context, dbName, collectionName string, filter, result interface{}) (bool, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+
+	err := collection.FindOne(ctx, filter).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindDocuments decodes every document matching filter into results, which
+// must be a pointer to a slice.
+func FindDocuments(ctx context.Context, dbName, collectionName string, filter, results interface{}) error {
+	collection := client.Database(dbName).Collection(collectionName)
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+func UpdateDocument(ctx context.Context, dbName, collectionName string, filter, update interface{}) error {
+	collection := client.Database(dbName).Collection(collectionName)
+
+	_, err := collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// UpsertDocument applies update to the document matching filter, inserting
+// it if there is none, and reports whether it was inserted.
+func UpsertDocument(ctx context.Context, dbName, collectionName string, filter, update interface{}) (bool, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+
+	result, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+// EnsureIndex creates an ascending index over fields if it does not exist.
+func EnsureIndex(ctx context.Context, dbName, collectionName string, fields ...string) error {
+	collection := client.Database(dbName).Collection(collectionName)
+
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: 1})
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+	return err
+}
+
+// FindAndUpdateDocument atomically applies update to the first document
+// matching filter and decodes the updated document into result. It reports
+// whether a document matched.
+func FindAndUpdateDocument(ctx context.Context, dbName, collectionName string, filter, update, result interface{}) (bool, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,59 @@
+package mongo
+
+import (
+	"context"
+	"dunlap/app/log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var quoteIndexOnce sync.Once
+
+type cachedQuote struct {
+	Key       string    `bson:"_id"`
+	Response  []byte    `bson:"response"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+func ensureQuoteCacheIndex(ctx context.Context, collection *mongo.Collection) {
+	quoteIndexOnce.Do(func() {
+		model := mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}
+		if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+			log.Error("Error creating quote cache TTL index: %v", err)
+		}
+	})
+}
+
+// FindCachedQuote returns the stored response for key if it has not expired.
+func FindCachedQuote(ctx context.Context, dbName, collectionName, key string) ([]byte, bool, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+
+	var result cachedQuote
+	filter := bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}}
+	err := collection.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return result.Response, true, nil
+}
+
+// StoreCachedQuote upserts the response for key with the given expiry. The
+// collection carries a TTL index so expired entries are removed by Mongo.
+func StoreCachedQuote(ctx context.Context, dbName, collectionName, key string, response []byte, expiresAt time.Time) error {
+	collection := client.Database(dbName).Collection(collectionName)
+	ensureQuoteCacheIndex(ctx, collection)
+
+	update := bson.M{"$set": bson.M{"response": response, "expiresAt": expiresAt}}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": key}, update, options.Update().SetUpsert(true))
+	return err
+}
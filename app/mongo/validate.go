@@ -2,42 +2,127 @@ package mongo
 
 import (
 	"context"
+	"crypto/subtle"
 	"dunlap/app/log"
+	"strings"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func ValidateMongoKey(uri, databaseName, collectionName, providedAPIKey string) bool {
-	log.Info("Validating Key in Mongo")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// APIKey is a document in the apikeys collection. Keys are stored as the
+// public Prefix of the token and a KeyHash of its secret; APIKey holds the
+// plaintext only for documents that have not been migrated yet.
+type APIKey struct {
+	ID           primitive.ObjectID `bson:"_id"`
+	APIKey       string             `bson:"apiKey,omitempty"`
+	Prefix       string             `bson:"prefix,omitempty"`
+	KeyHash      string             `bson:"keyHash,omitempty"`
+	Tenant       string             `bson:"tenant,omitempty"`
+	CarrierAllow []string           `bson:"carrierAllow,omitempty"`
+	CarrierDeny  []string           `bson:"carrierDeny,omitempty"`
+	AutoClass    bool               `bson:"autoClass,omitempty"`
+	Scopes       []string           `bson:"scopes,omitempty"`
+	// RequestsPerMinute, DailyStopQuota and MonthlyStopQuota limit the key's
+	// traffic; zero means unlimited.
+	RequestsPerMinute int `bson:"requestsPerMinute,omitempty"`
+	DailyStopQuota    int `bson:"dailyStopQuota,omitempty"`
+	MonthlyStopQuota  int `bson:"monthlyStopQuota,omitempty"`
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
-	if err != nil {
-		log.Error("Error connecting to MongoDB: %v", err)
-		return false
+	Label       string     `bson:"label,omitempty"`
+	Owner       string     `bson:"owner,omitempty"`
+	CreatedAt   time.Time  `bson:"createdAt,omitempty"`
+	LastUsedAt  *time.Time `bson:"lastUsedAt,omitempty"`
+	ExpiresAt   *time.Time `bson:"expiresAt,omitempty"`
+	Disabled    bool       `bson:"disabled,omitempty"`
+	RotatedFrom string     `bson:"rotatedFrom,omitempty"`
+	ReplacedBy  string     `bson:"replacedBy,omitempty"`
+	// Lineage is the ID of the first key in this one's rotation chain, carried
+	// forward through every rotation.
+	Lineage string `bson:"lineage,omitempty"`
+}
+
+// Active reports whether the key may authenticate requests at now.
+func (k *APIKey) Active(now time.Time) bool {
+	return !k.Disabled && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// UsageID names the key's usage counters. Rotated keys share their
+// lineage's, so rotating a key does not reset its quotas.
+func (k *APIKey) UsageID() string {
+	if k.Lineage != "" {
+		return k.Lineage
 	}
-	defer client.Disconnect(ctx)
+	return k.ID.Hex()
+}
 
+// TenantID names the tenant the key belongs to, falling back to the key's
+// own document ID for keys issued before tenants existed.
+func (k *APIKey) TenantID() string {
+	if k.Tenant != "" {
+		return k.Tenant
+	}
+	return k.ID.Hex()
+}
+
+// FindMongoKey returns the key document matching providedAPIKey, or nil if
+// there is none. It uses the pooled client from ConnectMongoDB.
+//
+// Tokens of the form prefix.secret are found by prefix and checked against
+// the stored hash of the secret. Keys issued before prefixes existed are
+// found by the hash of the whole token, or by the plaintext until
+// MigratePlaintextAPIKeys has converted them.
+func FindMongoKey(ctx context.Context, databaseName, collectionName, providedAPIKey string) (*APIKey, error) {
 	collection := client.Database(databaseName).Collection(collectionName)
 
-	filter := map[string]string{"apiKey": providedAPIKey}
+	var result APIKey
+
+	if prefix, secret, ok := strings.Cut(providedAPIKey, "."); ok && prefix != "" {
+		err := collection.FindOne(ctx, bson.M{"prefix": prefix}).Decode(&result)
+		if err == nil {
+			matched, err := verifyAPIKeySecret(result.KeyHash, secret)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				return &result, nil
+			}
+			log.Error("API key secret does not match")
+			return nil, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			log.Error("Error querying MongoDB: %v", err)
+			return nil, err
+		}
+	}
 
-	var result struct {
-		APIKey string `bson:"apiKey"`
+	hash, err := HashAPIKeySecret(providedAPIKey)
+	if err != nil {
+		return nil, err
 	}
+	filter := bson.M{"$or": []bson.M{
+		{"keyHash": hash, "prefix": bson.M{"$exists": false}},
+		{"apiKey": providedAPIKey},
+	}}
 
 	err = collection.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		log.Error("API key not found")
+		return nil, nil
+	}
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Error("API key not found")
-		} else {
-			log.Error("Error querying MongoDB: %v", err)
-		}
-		return false
+		log.Error("Error querying MongoDB: %v", err)
+		return nil, err
 	}
 
-	return result.APIKey == providedAPIKey
+	if result.KeyHash != "" {
+		if subtle.ConstantTimeCompare([]byte(result.KeyHash), []byte(hash)) != 1 {
+			return nil, nil
+		}
+	} else if subtle.ConstantTimeCompare([]byte(result.APIKey), []byte(providedAPIKey)) != 1 {
+		return nil, nil
+	}
+	return &result, nil
 }
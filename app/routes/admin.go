@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"dunlap/app/handlers"
+	"encoding/json"
+	"net/http"
+)
+
+func CircuitBreakerStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handlers.Breaker.Snapshot())
+}
+
+func CoalescingStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handlers.Inflight.Stats())
+}
+
+func ConcurrencyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handlers.Limiter.Stats())
+}
+
+func RateLimitStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handlers.Outbound.Stats())
+}
+
+func HedgingStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handlers.Hedging.Stats())
+}
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"dunlap/app/handlers"
+	"dunlap/app/log"
+	"dunlap/app/middleware"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultRotationGrace = 24 * time.Hour
+
+// actorFor names the admin key making a change, for the audit log.
+func actorFor(r *http.Request) string {
+	if key := middleware.KeyFromContext(r.Context()); key != nil {
+		return key.ID.Hex()
+	}
+	return ""
+}
+
+// respondWithKeyError maps a lifecycle error to a response and reports
+// whether there was one.
+func respondWithKeyError(w http.ResponseWriter, id, action string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, handlers.ErrAPIKeyNotFound) {
+		handlers.RespondWithError(w, http.StatusNotFound, "API key not found")
+		return true
+	}
+	if errors.Is(err, handlers.ErrAPIKeyInactive) {
+		handlers.RespondWithError(w, http.StatusConflict, err.Error())
+		return true
+	}
+	log.Error("Error trying to %s API key %s: %v", action, id, err)
+	handlers.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error trying to %s API key", action))
+	return true
+}
+
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var spec handlers.APIKeySpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		handlers.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Error Parsing API Key: %s", err))
+		return
+	}
+	if spec.Owner == "" {
+		handlers.RespondWithError(w, http.StatusBadRequest, "owner is required")
+		return
+	}
+	for _, scope := range spec.Scopes {
+		if !middleware.ValidScope(scope) {
+			handlers.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("unknown scope %q", scope))
+			return
+		}
+	}
+
+	issued, err := handlers.CreateAPIKey(r.Context(), spec, actorFor(r))
+	if err != nil {
+		log.Error("Error creating API key: %v", err)
+		handlers.RespondWithError(w, http.StatusInternalServerError, "Error creating API key")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(issued)
+}
+
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	keys, err := handlers.ListAPIKeys(r.Context(), query.Get("owner"), query.Get("tenant"))
+	if err != nil {
+		log.Error("Error listing API keys: %v", err)
+		handlers.RespondWithError(w, http.StatusInternalServerError, "Error listing API keys")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RotateAPIKeyHandler accepts an optional grace query parameter such as
+// "72h"; it defaults to API_KEY_ROTATION_GRACE or 24 hours.
+func RotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	grace := defaultRotationGrace
+	if value := os.Getenv("API_KEY_ROTATION_GRACE"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed >= 0 {
+			grace = parsed
+		} else {
+			log.Warning("Invalid duration for API_KEY_ROTATION_GRACE: %q, using %v", value, grace)
+		}
+	}
+	if value := r.URL.Query().Get("grace"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			handlers.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid grace %q: expected a duration such as 72h", value))
+			return
+		}
+		grace = parsed
+	}
+
+	issued, err := handlers.RotateAPIKey(r.Context(), id, grace, actorFor(r))
+	if respondWithKeyError(w, id, "rotate", err) {
+		return
+	}
+	middleware.Keys.InvalidateID(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(issued)
+}
+
+func DisableAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if respondWithKeyError(w, id, "disable", handlers.DisableAPIKey(r.Context(), id, actorFor(r))) {
+		return
+	}
+	middleware.Keys.InvalidateID(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExpireAPIKeyHandler expires the key now, or at the RFC3339 time in the
+// optional body {"expiresAt": "..."}.
+func ExpireAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var body struct {
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			handlers.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Error Parsing Expiry: %s", err))
+			return
+		}
+	}
+	at := time.Now()
+	if body.ExpiresAt != nil {
+		at = *body.ExpiresAt
+	}
+
+	if respondWithKeyError(w, id, "expire", handlers.ExpireAPIKey(r.Context(), id, at, actorFor(r))) {
+		return
+	}
+	middleware.Keys.InvalidateID(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if respondWithKeyError(w, id, "delete", handlers.DeleteAPIKey(r.Context(), id, actorFor(r))) {
+		return
+	}
+	middleware.Keys.InvalidateID(id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -12,7 +12,7 @@ type TokenResponse struct {
 }
 
 func GetOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
-	accessToken, err := handlers.GetOAuthToken()
+	accessToken, err := handlers.Tokens.Token(r.Context())
 	if err != nil {
 		log.Error("Problem with auth Function %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"dunlap/app/handlers"
+	"dunlap/app/log"
+	"dunlap/app/middleware"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type JobAcceptedResponse struct {
+	JobID  string `json:"jobId"`
+	Status string `json:"status"`
+	Total  int    `json:"total"`
+}
+
+func SubmitRatingJobHandler(w http.ResponseWriter, r *http.Request) {
+	requests, err := handlers.ParseRequests(r)
+	if err != nil {
+		parsingError := fmt.Sprintf("Error Parsing Requests: %s", err)
+		handlers.RespondWithError(w, http.StatusBadRequest, parsingError)
+		return
+	}
+
+	if violations := handlers.ValidateRequests(requests); len(violations) > 0 && r.URL.Query().Get("validation") != "partial" {
+		handlers.RespondWithViolations(w, violations)
+		return
+	}
+	handlers.NormalizeUnits(requests)
+	handlers.ClassifyRequests(requests, autoClassFor(r))
+
+	options, err := handlers.ParseQuoteOptions(r)
+	if err != nil {
+		handlers.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job, err := handlers.CreateRatingJob(r.Context(), requests, handlers.CacheModeFromRequest(r), middleware.TenantFromContext(r.Context()), options, carrierPolicyFor(r))
+	if err != nil {
+		log.Error("Error creating rating job: %v", err)
+		handlers.RespondWithError(w, http.StatusInternalServerError, "Error creating rating job")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", r.URL.Path+"/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(JobAcceptedResponse{JobID: job.ID, Status: job.Status, Total: job.Total})
+}
+
+func GetRatingJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	job, found, err := handlers.GetRatingJob(r.Context(), id, middleware.TenantFromContext(r.Context()))
+	if err != nil {
+		log.Error("Error loading rating job %s: %v", id, err)
+		handlers.RespondWithError(w, http.StatusInternalServerError, "Error loading rating job")
+		return
+	}
+	if !found {
+		handlers.RespondWithError(w, http.StatusNotFound, "Rating job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -1,10 +1,14 @@
 package routes
 
 import (
+	"context"
 	"dunlap/app/handlers"
 	"dunlap/app/log"
+	"dunlap/app/middleware"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -12,6 +16,13 @@ func SubmitRatingHandler(w http.ResponseWriter, r *http.Request) {
 
 	startTime := time.Now()
 
+	if overloaded, retryAfter := handlers.Limiter.Overloaded(); overloaded {
+		log.Warning("Shedding rating batch, upstream wait queue is full")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		handlers.RespondWithError(w, http.StatusServiceUnavailable, "Too many rating requests in progress, try again later")
+		return
+	}
+
 	requests, err := handlers.ParseRequests(r)
 	if err != nil {
 		parsingError := fmt.Sprintf("Error Parsing Requests: %s", err)
@@ -19,15 +30,53 @@ func SubmitRatingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if violations := handlers.ValidateRequests(requests); len(violations) > 0 && r.URL.Query().Get("validation") != "partial" {
+		handlers.RespondWithViolations(w, violations)
+		return
+	}
+	handlers.NormalizeUnits(requests)
+	handlers.ClassifyRequests(requests, autoClassFor(r))
+
+	options, err := handlers.ParseQuoteOptions(r)
+	if err != nil {
+		handlers.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel, err := handlers.BatchContext(r)
+	if err != nil {
+		handlers.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+
 	processor, err := handlers.NewRequestProcessor()
 
 	if err != nil {
+		log.Error("Error creating request processor: %v", err)
 		requestError := fmt.Sprintf("Error Handling Requests: %s", err)
-		handlers.RespondWithError(w, http.StatusBadRequest, requestError)
+		handlers.RespondWithError(w, http.StatusServiceUnavailable, requestError)
 		return
 	}
 
-	responses, err := processor.ProcessRequestsInParallel(requests)
+	processor.Cache = handlers.CacheModeFromRequest(r)
+	processor.Tenant = middleware.TenantFromContext(r.Context())
+	processor.Options = options
+	processor.Carriers = carrierPolicyFor(r)
+	processor.Markup, err = handlers.LoadMarkupRules(ctx, processor.Tenant)
+	if err != nil {
+		log.Error("Error loading markup rules for tenant %s: %v", processor.Tenant, err)
+		handlers.RespondWithError(w, http.StatusInternalServerError, "Error loading markup rules")
+		return
+	}
+
+	if contentType := handlers.NegotiateStream(r); contentType != "" {
+		streamRatings(ctx, w, processor, requests, contentType)
+		log.Info("Streamed request completed in %.2f seconds", time.Since(startTime).Seconds())
+		return
+	}
+
+	responses, err := processor.ProcessRequestsInParallel(ctx, requests)
 
 	if err != nil {
 		conncurencyError := fmt.Sprintf("Error Handling Requests: %s", err)
@@ -41,3 +90,37 @@ func SubmitRatingHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info("Request completed in %.2f seconds", duration.Seconds())
 
 }
+
+func streamRatings(ctx context.Context, w http.ResponseWriter, processor *handlers.RequestProcessor, requests []handlers.PayloadRequest, contentType string) {
+	stream, err := handlers.NewResultStream(w, contentType)
+	if err != nil {
+		handlers.RespondWithError(w, http.StatusNotAcceptable, err.Error())
+		return
+	}
+
+	processor.OnResult = func(index int, response handlers.ResponseWithStopID) {
+		stream.WriteResult(response)
+	}
+
+	if _, err := processor.ProcessRequestsInParallel(ctx, requests); err != nil {
+		log.Error("Error Handling Requests: %s", err)
+	}
+	stream.Close()
+}
+
+// carrierPolicyFor builds the carrier allow/deny lists stored on the caller's
+// API key.
+func carrierPolicyFor(r *http.Request) handlers.CarrierPolicy {
+	key := middleware.KeyFromContext(r.Context())
+	if key == nil {
+		return handlers.CarrierPolicy{}
+	}
+	return handlers.NewCarrierPolicy(key.CarrierAllow, key.CarrierDeny)
+}
+
+// autoClassFor reports whether the caller's tenant wants freight classes
+// derived from density even when one was supplied.
+func autoClassFor(r *http.Request) bool {
+	key := middleware.KeyFromContext(r.Context())
+	return key != nil && key.AutoClass
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"dunlap/app/handlers"
 	"dunlap/app/log"
 	"dunlap/app/middleware"
+	"dunlap/app/mongo"
 	"dunlap/app/routes"
 	"net/http"
 	"os"
@@ -24,16 +26,53 @@ func main() {
 
 	log.InitializeMongoDBLogger(true, 100)
 
+	if err := mongo.ConnectMongoDB(os.Getenv("MongoURI")); err != nil {
+		log.Fatal("Error connecting to MongoDB: %v", err)
+	}
+
+	if err := mongo.CheckAPIKeyPepper(); err != nil {
+		log.Fatal("Cannot check or issue API keys: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate-api-keys" {
+		migrateAPIKeys()
+		return
+	}
+
+	middleware.Keys = middleware.LoadKeyCache()
+	handlers.InitializeUpstream()
+	handlers.ResumeRatingJobs()
+
 	corsHandler := middleware.SetupCORS()
 
 	r := mux.NewRouter()
 
 	r.Use(middleware.ApiKeyMiddleware)
+	r.Use(middleware.KeyRateLimitMiddleware)
 	r.Use(corsHandler.Handler)
 	r.Use(middleware.RequestIDMiddleware)
 
-	r.HandleFunc(os.Getenv("TOKEN_PATH"), routes.GetOAuthTokenHandler).Methods("POST")
-	r.HandleFunc(os.Getenv("RATING_PATH"), routes.SubmitRatingHandler).Methods("POST")
+	r.Handle(os.Getenv("TOKEN_PATH"), middleware.RequireScope(middleware.ScopeTokenRead, routes.GetOAuthTokenHandler)).Methods("POST")
+	r.Handle(os.Getenv("RATING_PATH"), middleware.RequireScope(middleware.ScopeRatingSubmit, middleware.StopQuota(routes.SubmitRatingHandler))).Methods("POST")
+	jobsPath := os.Getenv("JOBS_PATH")
+	if jobsPath == "" {
+		jobsPath = "/rating/jobs"
+	}
+	r.Handle(jobsPath, middleware.RequireScope(middleware.ScopeRatingSubmit, middleware.StopQuota(routes.SubmitRatingJobHandler))).Methods("POST")
+	r.Handle(jobsPath+"/{id}", middleware.RequireScope(middleware.ScopeJobsRead, routes.GetRatingJobHandler)).Methods("GET")
+
+	r.Handle("/admin/circuit-breaker", middleware.RequireScope(middleware.ScopeAdmin, routes.CircuitBreakerStatusHandler)).Methods("GET")
+	r.Handle("/admin/coalescing", middleware.RequireScope(middleware.ScopeAdmin, routes.CoalescingStatsHandler)).Methods("GET")
+	r.Handle("/admin/concurrency", middleware.RequireScope(middleware.ScopeAdmin, routes.ConcurrencyStatsHandler)).Methods("GET")
+	r.Handle("/admin/rate-limits", middleware.RequireScope(middleware.ScopeAdmin, routes.RateLimitStatsHandler)).Methods("GET")
+	r.Handle("/admin/hedging", middleware.RequireScope(middleware.ScopeAdmin, routes.HedgingStatsHandler)).Methods("GET")
+
+	r.Handle("/admin/apikeys", middleware.RequireScope(middleware.ScopeAdmin, routes.CreateAPIKeyHandler)).Methods("POST")
+	r.Handle("/admin/apikeys", middleware.RequireScope(middleware.ScopeAdmin, routes.ListAPIKeysHandler)).Methods("GET")
+	r.Handle("/admin/apikeys/{id}", middleware.RequireScope(middleware.ScopeAdmin, routes.DeleteAPIKeyHandler)).Methods("DELETE")
+	r.Handle("/admin/apikeys/{id}/rotate", middleware.RequireScope(middleware.ScopeAdmin, routes.RotateAPIKeyHandler)).Methods("POST")
+	r.Handle("/admin/apikeys/{id}/disable", middleware.RequireScope(middleware.ScopeAdmin, routes.DisableAPIKeyHandler)).Methods("POST")
+	r.Handle("/admin/apikeys/{id}/expire", middleware.RequireScope(middleware.ScopeAdmin, routes.ExpireAPIKeyHandler)).Methods("POST")
 
 	serverPort := os.Getenv("SERVER_PORT")
 	if serverPort == "" {
@@ -64,5 +103,27 @@ func main() {
 		log.Fatal("Server forced to shutdown: %v", err)
 	}
 
+	if err := mongo.DisconnectMongoDB(ctx); err != nil {
+		log.Error("Error disconnecting from MongoDB: %v", err)
+	}
+
 	log.Info("Server exiting")
 }
+
+// migrateAPIKeys hashes every API key still stored in plaintext. Run it as
+// "main migrate-api-keys" once every replica is on a build that accepts
+// hashed keys.
+func migrateAPIKeys() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	migrated, err := mongo.MigratePlaintextAPIKeys(ctx, "honda", "apikeys")
+	if err != nil {
+		log.Fatal("Error migrating API keys after %d: %v", migrated, err)
+	}
+	log.Info("Hashed %d plaintext API key(s)", migrated)
+
+	if err := mongo.DisconnectMongoDB(ctx); err != nil {
+		log.Error("Error disconnecting from MongoDB: %v", err)
+	}
+}